@@ -102,7 +102,7 @@ function Updater:check()
 	local headers = utils.format_json({
 		Accept = 'application/vnd.github+json',
 	})
-	local args = {'http-get', '--headers', headers, url}
+	local args = {'http-get', '--parse-json', '--headers', headers, url}
 
 	self:append_output('Fetching: ' .. url)
 
@@ -112,7 +112,7 @@ function Updater:check()
 			return
 		end
 
-		release = utils.parse_json(type(response.body) == 'string' and response.body or '')
+		release = response.json
 		if response.status == 200 and type(release) == 'table' and type(release.tag_name) == 'string' then
 			self.update_available = config.version ~= release.tag_name
 			self:append_output('Response: 200 OK')
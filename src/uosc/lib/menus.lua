@@ -949,7 +949,7 @@ function open_subtitle_downloader()
 		return false
 	end
 
-	---@param data {kind: 'file', id: number}|{kind: 'page', query: string, page: number}
+	---@param data {kind: 'file', id: string}|{kind: 'page', query: string, page: number}
 	handle_download = function(data)
 		if data.kind == 'page' then
 			handle_search(data.query, data.page)
@@ -1033,24 +1033,20 @@ function open_subtitle_downloader()
 			if not menu:is_alive() then return end
 
 			local function check_is_valid(data)
-				return type(data.data) == 'table' and data.page and data.total_pages
+				return type(data.items) == 'table' and data.page and data.total_pages
 			end
 
 			if should_abort(error, data, check_is_valid) then return end
 
-			local subs = itable_filter(data.data, function(sub)
-				return sub and sub.attributes and sub.attributes.release and type(sub.attributes.files) == 'table' and
-					#sub.attributes.files > 0
-			end)
-			local items = itable_map(subs, function(sub)
-				local hints = {sub.attributes.language}
-				if sub.attributes.foreign_parts_only then hints[#hints + 1] = t('foreign parts only') end
-				if sub.attributes.hearing_impaired then hints[#hints + 1] = t('hearing impaired') end
-				local url = sub.attributes.url
+			local items = itable_map(data.items, function(sub)
+				local hints = {sub.language}
+				if sub.foreign_parts_only then hints[#hints + 1] = t('foreign parts only') end
+				if sub.hearing_impaired then hints[#hints + 1] = t('hearing impaired') end
+				local url = sub.url
 				return {
-					title = sub.attributes.release,
+					title = sub.release,
 					hint = table.concat(hints, ', '),
-					value = {kind = 'file', id = sub.attributes.files[1].file_id, url = url},
+					value = {kind = 'file', id = sub.files[1].id, url = url},
 					keep_open = true,
 					actions = url and
 						{{name = 'open_in_browser', icon = 'open_in_new', label = t('Open in browser') .. ' (shift)'}},
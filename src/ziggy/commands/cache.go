@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+// Cached response metadata. Entry file is this as a JSON line, followed by the raw body,
+// so that it can be replaced atomically.
+type cacheEntry struct {
+	Url      string      `json:"url"`
+	Status   int         `json:"status"`
+	Headers  http.Header `json:"headers"`
+	StoredAt time.Time   `json:"stored_at"`
+	// Redirects followed to get the response, so they can be reported when answering from cache.
+	Redirects []lib.Redirect `json:"redirects,omitempty"`
+	body      []byte
+}
+
+// Whether the entry can be used without asking the server, according to its `Cache-Control: max-age`.
+func (e cacheEntry) fresh(now time.Time) bool {
+	directives := cacheControl(e.Headers)
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+	maxAge, err := strconv.Atoi(directives["max-age"])
+	if err != nil {
+		return false
+	}
+	age, _ := strconv.Atoi(e.Headers.Get("Age"))
+	return now.Sub(e.StoredAt) < time.Duration(maxAge-age)*time.Second
+}
+
+func (e cacheEntry) response(req *http.Request) *http.Response {
+	// Recreate the redirect chain
+	for _, hop := range e.Redirects {
+		redirectURL, err := url.Parse(hop.Location)
+		if err != nil {
+			break
+		}
+		previous := req
+		req = req.Clone(req.Context())
+		req.URL = redirectURL
+		req.Response = &http.Response{StatusCode: hop.Status, Request: previous}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Header:        e.Headers,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// Parses `Cache-Control` directives into a map of lowercase names to their values.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// On-disk cache of GET responses, used by `http-get --cache-dir`.
+type httpCache struct {
+	dir string
+	// Larger responses aren't cached. 0 means no limit.
+	maxBodyBytes int64
+	// Non-default redirect policy, e.g. `no-follow`, or max redirects. Empty for the default.
+	redirectPolicy string
+}
+
+// Entries are keyed by URL, all request headers, and redirect policy, so responses that vary by them never mix.
+func (c httpCache) entryPath(req *http.Request) string {
+	hash := sha256.New()
+	fmt.Fprintln(hash, req.Method, req.URL.String())
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintln(hash, name, strings.Join(req.Header.Values(name), ", "))
+	}
+	if c.redirectPolicy != "" {
+		fmt.Fprintln(hash, "redirects", c.redirectPolicy)
+	}
+	return filepath.Join(c.dir, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// Loads an entry. Missing or unreadable entries are reported as not found.
+func (c httpCache) load(entryPath string) (cacheEntry, bool) {
+	var entry cacheEntry
+	data, err := os.ReadFile(entryPath)
+	if err != nil {
+		return entry, false
+	}
+	meta, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || json.Unmarshal(meta, &entry) != nil {
+		return entry, false
+	}
+	entry.body = body
+	return entry, true
+}
+
+func (c httpCache) store(entryPath string, entry cacheEntry) error {
+	var data bytes.Buffer
+	if err := json.NewEncoder(&data).Encode(entry); err != nil {
+		return lib.WrapError(lib.CodeInternal, err, "failed to encode cache entry")
+	}
+	data.Write(entry.body)
+	return lib.WriteFileAtomic(entryPath, data.Bytes(), 0644)
+}
+
+// Answers the request from cache when the entry is fresh, and otherwise makes a conditional request,
+// updating the cache with the response. Returns the response, and whether it came from the cache.
+func (c httpCache) do(client *lib.HTTPClient, req *http.Request) (*http.Response, bool, error) {
+	entryPath := c.entryPath(req)
+	entry, cached := c.load(entryPath)
+	if cached && entry.fresh(time.Now()) {
+		return entry.response(req), true, nil
+	}
+
+	// Ask the server whether our entry is still valid, unless caller asked for something specific
+	if cached && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		if etag := entry.Headers.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Headers.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Not modified, so refresh the entry with the new headers
+	if cached && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		for name, values := range resp.Header {
+			entry.Headers[name] = values
+		}
+		entry.StoredAt = time.Now().UTC()
+		c.store(entryPath, entry)
+		return entry.response(req), true, nil
+	}
+
+	directives := cacheControl(resp.Header)
+	if _, noStore := directives["no-store"]; noStore {
+		os.Remove(entryPath)
+		return resp, false, nil
+	}
+	_, hasMaxAge := directives["max-age"]
+	cacheable := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" || hasMaxAge
+	if resp.StatusCode != http.StatusOK || !cacheable {
+		return resp, false, nil
+	}
+
+	// Store the response, and pass its body on from memory
+	var reader io.Reader = resp.Body
+	if c.maxBodyBytes > 0 {
+		reader = io.LimitReader(resp.Body, c.maxBodyBytes+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		resp.Body.Close()
+		return nil, false, lib.WrapCopyError(err, "failed to read response body")
+	}
+	if c.maxBodyBytes > 0 && int64(len(body)) > c.maxBodyBytes {
+		// Too large to cache, so pass on what was read followed by the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, false, nil
+	}
+	resp.Body.Close()
+	entry = cacheEntry{
+		Url:       req.URL.String(),
+		Status:    resp.StatusCode,
+		Headers:   resp.Header,
+		StoredAt:  time.Now().UTC(),
+		Redirects: lib.Redirects(resp),
+		body:      body,
+	}
+	if err := c.store(entryPath, entry); err != nil {
+		return nil, false, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, false, nil
+}
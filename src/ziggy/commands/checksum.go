@@ -0,0 +1,139 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// Hex digest length of each algorithm, used to recognize manifest entries.
+var checksumLengths = map[int]string{
+	sha256.Size * 2: "sha256",
+	sha1.Size * 2:   "sha1",
+	md5.Size * 2:    "md5",
+}
+
+type checksumMismatchDetails struct {
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+// Hashes everything written into it with multiple algorithms at once.
+type checksumWriter map[string]hash.Hash
+
+func newChecksumWriter(algorithms []string) checksumWriter {
+	writer := checksumWriter{}
+	for _, algorithm := range algorithms {
+		writer[algorithm] = checksumAlgorithms[algorithm]()
+	}
+	return writer
+}
+
+func (w checksumWriter) Write(b []byte) (int, error) {
+	for _, h := range w {
+		h.Write(b)
+	}
+	return len(b), nil
+}
+
+// Hex encoded digests by algorithm.
+func (w checksumWriter) sums() map[string]string {
+	sums := map[string]string{}
+	for algorithm, h := range w {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// Compares computed checksums with the expected ones.
+func verifyChecksums(expected map[string]string, actual map[string]string) error {
+	for algorithm, expectedSum := range expected {
+		if !strings.EqualFold(expectedSum, actual[algorithm]) {
+			return lib.NewError(lib.CodeChecksumMismatch, "%s checksum mismatch", algorithm).WithDetails(checksumMismatchDetails{
+				Algorithm: algorithm,
+				Expected:  strings.ToLower(expectedSum),
+				Actual:    actual[algorithm],
+			})
+		}
+	}
+	return nil
+}
+
+// Checksum manifest entry, e.g. a line of `SHA256SUMS` file.
+type checksumEntry struct {
+	algorithm string
+	sum       string
+}
+
+// Fetches and parses a `SHA256SUMS` style manifest with `<hex digest> [*]<file name>` lines.
+// Algorithm of each entry is recognized by the digest length.
+func fetchChecksumManifest(ctx context.Context, client *lib.HTTPClient, url string) (map[string]checksumEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid --checksum-url")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, lib.HTTPStatusError(resp)
+	}
+
+	entries := map[string]checksumEntry{}
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		algorithm, ok := checksumLengths[len(fields[0])]
+		if _, err := hex.DecodeString(fields[0]); !ok || err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+		entries[path.Base(name)] = checksumEntry{algorithm: algorithm, sum: strings.ToLower(fields[0])}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, lib.WrapCopyError(err, "failed to read checksum manifest")
+	}
+	if len(entries) == 0 {
+		return nil, lib.NewError(lib.CodeInvalidResponse, "checksum manifest has no entries")
+	}
+
+	return entries, nil
+}
+
+// Finds a manifest entry for the first matching name. Single entry manifests match any name.
+func findChecksumEntry(entries map[string]checksumEntry, names ...string) (checksumEntry, bool) {
+	for _, name := range names {
+		if entry, ok := entries[name]; ok && name != "" {
+			return entry, true
+		}
+	}
+	if len(entries) == 1 {
+		for _, entry := range entries {
+			return entry, true
+		}
+	}
+	return checksumEntry{}, false
+}
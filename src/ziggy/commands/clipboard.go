@@ -1,9 +1,8 @@
 package commands
 
 import (
-	"errors"
+	"context"
 	"flag"
-	"fmt"
 	"strings"
 	"uosc/bins/src/ziggy/lib"
 
@@ -14,26 +13,36 @@ type ClipboardResult struct {
 	Payload string `json:"payload"`
 }
 
-func GetClipboard(_ []string) {
+func GetClipboard(_ context.Context, args []string) any {
+	lib.Check(lib.ParseFlags(newGetClipboardFlags(), args))
+
 	// We need to do this instead of just `Payload: lib.Must(clipboard.ReadAll())` because
 	// the atotto/clipboard returns unhelpful messages like "the operation completed successfully".
 	payload, err := clipboard.ReadAll()
 	if err != nil {
 		if strings.Contains(strings.ToLower(err.Error()), "successfully") {
-			lib.Check(errors.New("clipboard format not supported"))
+			lib.Check(lib.NewError(lib.CodeUnsupportedFormat, "clipboard format not supported"))
 		}
-		lib.Check(err)
+		lib.Check(lib.WrapError(lib.CodeUnavailable, err, ""))
 	}
 
-	fmt.Print(string(lib.Must(lib.JSONMarshal(ClipboardResult{
+	return ClipboardResult{
 		Payload: payload,
-	}))))
+	}
 }
 
-func SetClipboard(args []string) {
-	cmd := flag.NewFlagSet("set-clipboard", flag.ExitOnError)
+func newGetClipboardFlags() *flag.FlagSet {
+	return flag.NewFlagSet("get-clipboard", flag.ContinueOnError)
+}
+
+func newSetClipboardFlags() *flag.FlagSet {
+	return flag.NewFlagSet("set-clipboard", flag.ContinueOnError)
+}
 
-	lib.Check(cmd.Parse(args))
+func SetClipboard(_ context.Context, args []string) any {
+	cmd := newSetClipboardFlags()
+
+	lib.Check(lib.ParseFlags(cmd, args))
 
 	values := cmd.Args()
 	value := ""
@@ -41,11 +50,11 @@ func SetClipboard(args []string) {
 		value = values[0]
 	}
 
-	lib.Check(cmd.Parse(args))
-
-	lib.Check(clipboard.WriteAll(value))
+	if err := clipboard.WriteAll(value); err != nil {
+		lib.Check(lib.WrapError(lib.CodeUnavailable, err, ""))
+	}
 
-	fmt.Print(string(lib.Must(lib.JSONMarshal(ClipboardResult{
+	return ClipboardResult{
 		Payload: value,
-	}))))
+	}
 }
@@ -1,13 +1,20 @@
 package commands
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"uosc/bins/src/ziggy/lib"
@@ -15,83 +22,494 @@ import (
 
 type DownloadResult struct {
 	Url      string `json:"url"`
-	Path     string `json:"path"`
-	Filename string `json:"filename"` // Filename suggested by disposition header. Can be empty.
+	Path     string `json:"path"`     // Final path of the file, which can differ from `--path` with `--on-conflict=rename`.
+	Filename string `json:"filename"` // Filename suggested by the server, or derived from URL and content type.
+	Resumed  bool   `json:"resumed"`  // Whether a previously interrupted download was resumed.
+	Skipped  bool   `json:"skipped"`  // File already existed and `--on-conflict=skip` was used.
+	// Hex encoded checksums by algorithm. Only computed for algorithms that were verified.
+	Checksums map[string]string `json:"checksums,omitempty"`
 }
 
-func Download(args []string) {
-	cmd := flag.NewFlagSet("download", flag.ExitOnError)
-	argUrl := cmd.String("url", "", "File URL.")
-	argPath := cmd.String("path", "", "File destination path.")
+type downloadFlags struct {
+	url         *string
+	path        *string
+	directory   *string
+	onConflict  *string
+	connections *int
+	progress    *bool
+	sha256      *string
+	sha1        *string
+	md5         *string
+	checksumUrl *string
+	client      lib.ClientFlags
+}
+
+func newDownloadFlags() (*flag.FlagSet, downloadFlags) {
+	cmd := flag.NewFlagSet("download", flag.ContinueOnError)
+	flags := defineDownloadFlags(cmd)
+	flags.progress = cmd.Bool("progress", false, "Stream progress events as JSON lines, followed by a result line.")
+	flags.client = lib.DefineClientFlags(cmd)
+	return cmd, flags
+}
+
+// Defines flags describing a download, shared by `download` and `download-queue add`.
+func defineDownloadFlags(cmd *flag.FlagSet) downloadFlags {
+	return downloadFlags{
+		url:         cmd.String("url", "", "File URL."),
+		path:        cmd.String("path", "", "File destination path."),
+		directory:   cmd.String("directory", "", "Destination directory. File name is picked from the response. Alternative to --path."),
+		onConflict:  cmd.String("on-conflict", "overwrite", "What to do when destination file exists: rename, overwrite, skip, or fail."),
+		connections: cmd.Int("connections", 1, "Number of connections to download the file over, when server supports ranges."),
+		sha256:      cmd.String("sha256", "", "Expected SHA-256 checksum of the file."),
+		sha1:        cmd.String("sha1", "", "Expected SHA-1 checksum of the file."),
+		md5:         cmd.String("md5", "", "Expected MD5 checksum of the file."),
+		checksumUrl: cmd.String("checksum-url", "", "URL of a SHA256SUMS style manifest to verify the file against."),
+	}
+}
+
+// What to do when destination file already exists.
+const (
+	conflictRename    = "rename"    // Add ` (1)` style suffix to the name.
+	conflictOverwrite = "overwrite" // Replace the existing file.
+	conflictSkip      = "skip"      // Keep the existing file, and don't download anything.
+	conflictFail      = "fail"      // Fail with `file_exists` error.
+)
+
+var conflictPolicies = []string{conflictRename, conflictOverwrite, conflictSkip, conflictFail}
+
+// Returned internally when download is skipped due to the conflict policy.
+var errDownloadSkipped = errors.New("download skipped")
+
+type downloadOptions struct {
+	client *lib.HTTPClient
+	// Destination passed to downloadFile is a directory, and file name is picked from the response.
+	directory  bool
+	onConflict string
+	// Download over multiple connections when more than 1, and server supports ranges.
+	connections int
+	progress    bool // Emit progress events while downloading.
+	// Expected hex encoded checksums by algorithm.
+	checksums map[string]string
+	// Checksums by file name from a manifest. Entry is picked once the file name is known.
+	checksumManifest map[string]checksumEntry
+}
+
+func Download(ctx context.Context, args []string) any {
+	cmd, flags := newDownloadFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
+	if *flags.progress {
+		lib.StartStream(ctx)
+	}
+	request := parseDownloadRequest(flags)
+	return lib.Must(request.download(ctx, lib.Must(flags.client.Client()), *flags.progress))
+}
 
-	lib.Check(cmd.Parse(args))
+// Validated download arguments. Persisted by `download-queue`, so changes have to stay backwards compatible.
+type DownloadRequest struct {
+	Url         string            `json:"url"`
+	Path        string            `json:"path,omitempty"`
+	Directory   string            `json:"directory,omitempty"`
+	OnConflict  string            `json:"on_conflict"`
+	Connections int               `json:"connections"`
+	Checksums   map[string]string `json:"checksums,omitempty"` // Expected hex encoded checksums by algorithm.
+	ChecksumUrl string            `json:"checksum_url,omitempty"`
+}
 
-	// Validation
-	if len(*argUrl) == 0 {
-		lib.Check(errors.New("--url is required"))
+// Validates download flags.
+func parseDownloadRequest(flags downloadFlags) DownloadRequest {
+	if len(*flags.url) == 0 {
+		lib.Check(lib.MissingArgument("url"))
+	}
+	if len(*flags.path) == 0 && len(*flags.directory) == 0 {
+		lib.Check(lib.NewError(lib.CodeMissingArgument, "--path or --directory is required"))
 	}
-	if len(*argPath) == 0 {
-		lib.Check(errors.New("--path is required"))
+	if len(*flags.path) > 0 && len(*flags.directory) > 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--path and --directory can't be used together"))
+	}
+	if *flags.connections < 1 || *flags.connections > maxConnections {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--connections has to be between 1 and %d", maxConnections))
+	}
+	if !slices.Contains(conflictPolicies, *flags.onConflict) {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--on-conflict has to be one of: %s", strings.Join(conflictPolicies, ", ")))
 	}
 
-	// Download & output the response
-	fmt.Print(string(lib.Must(lib.JSONMarshal(DownloadResult{
-		Url:      *argUrl,
-		Path:     *argPath,
-		Filename: lib.Must(downloadFile(*argUrl, *argPath)),
-	}))))
+	checksums := map[string]string{}
+	for algorithm, sum := range map[string]string{"sha256": *flags.sha256, "sha1": *flags.sha1, "md5": *flags.md5} {
+		if sum == "" {
+			continue
+		}
+		if _, err := hex.DecodeString(sum); err != nil || checksumLengths[len(sum)] != algorithm {
+			lib.Check(lib.NewError(lib.CodeInvalidArgument, "--%s is not a valid %s checksum", algorithm, algorithm))
+		}
+		checksums[algorithm] = sum
+	}
+
+	return DownloadRequest{
+		Url:         *flags.url,
+		Path:        *flags.path,
+		Directory:   *flags.directory,
+		OnConflict:  *flags.onConflict,
+		Connections: *flags.connections,
+		Checksums:   checksums,
+		ChecksumUrl: *flags.checksumUrl,
+	}
 }
 
-// Downloads file form URL to a filePath and returns a filename suggested by disposition header.
-func downloadFile(url, filePath string) (string, error) {
+// Downloads the file, emitting progress events when `progress` is enabled.
+func (r DownloadRequest) download(ctx context.Context, client *lib.HTTPClient, progress bool) (DownloadResult, error) {
+	var manifest map[string]checksumEntry
+	if len(r.ChecksumUrl) > 0 {
+		var err error
+		if manifest, err = fetchChecksumManifest(ctx, client, r.ChecksumUrl); err != nil {
+			return DownloadResult{}, err
+		}
+	}
+
+	destination := r.Path
+	if len(r.Directory) > 0 {
+		destination = r.Directory
+	}
+
+	info, err := downloadFile(ctx, r.Url, destination, downloadOptions{
+		client:           client,
+		directory:        len(r.Directory) > 0,
+		onConflict:       r.OnConflict,
+		connections:      r.Connections,
+		progress:         progress,
+		checksums:        r.Checksums,
+		checksumManifest: manifest,
+	})
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	return DownloadResult{
+		Url:       r.Url,
+		Path:      info.path,
+		Filename:  info.filename,
+		Resumed:   info.resumed,
+		Skipped:   info.skipped,
+		Checksums: info.checksums,
+	}, nil
+}
+
+// Paths of the partial download files, if they can be known ahead of the response.
+func (r DownloadRequest) partPaths() []string {
+	partPath := r.Path + ".part"
+	if len(r.Directory) > 0 {
+		partPath = directoryPartPath(r.Directory, r.Url)
+	}
+	return []string{partPath, partPath + ".json"}
+}
+
+// What downloadFile learned about the downloaded file.
+type downloadInfo struct {
+	path      string // Final destination path.
+	filename  string // Suggested by the server, or derived from URL and content type.
+	finalUrl  string // URL after redirects.
+	resumed   bool
+	skipped   bool
+	checksums map[string]string
+}
+
+// Validators of a partial download stored next to the `.part` file, used to resume it.
+type partialDownload struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Only used by segmented downloads, where part file is preallocated to the full size.
+	Size     int64             `json:"size,omitempty"`
+	Segments []downloadSegment `json:"segments,omitempty"`
+}
+
+// Value for the `If-Range` header, or empty when partial download can't be safely resumed.
+func (p partialDownload) ifRange() string {
+	// Weak ETags are not allowed in If-Range
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// Downloads file form URL to a destination path, or into a destination directory with `options.directory`.
+// Data is written into a `.part` file first, which is renamed to the final path once the download is complete.
+// When a `.part` file from an interrupted download exists and the server supports it, download is resumed.
+func downloadFile(ctx context.Context, url, destination string, options downloadOptions) (downloadInfo, error) {
 	// Ensure the directory exists
-	dir := filepath.Dir(filePath)
+	dir := filepath.Dir(destination)
+	if options.directory {
+		dir = destination
+	}
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
+		return downloadInfo{}, lib.WrapError(lib.CodeIO, err, "failed to create directory %s", dir)
+	}
+
+	// With exact path the conflict can be resolved right away, otherwise it has to wait for the response.
+	// Part file in directory mode is named after the URL so that it can be found when resuming.
+	var filePath, partPath string
+	if options.directory {
+		partPath = directoryPartPath(dir, url)
+	} else {
+		var err error
+		filePath, err = resolveConflict(destination, options.onConflict)
+		if errors.Is(err, errDownloadSkipped) {
+			return downloadInfo{path: filePath, filename: filepath.Base(filePath), skipped: true}, nil
+		} else if err != nil {
+			return downloadInfo{}, err
+		}
+		partPath = filePath + ".part"
+	}
+	metaPath := partPath + ".json"
+
+	// Picks the final path once the response is known
+	resolvePath := func(resp *http.Response) (err error) {
+		if filePath == "" {
+			filePath, err = resolveConflict(filepath.Join(dir, fileNameFromResponse(resp)), options.onConflict)
+		}
+		return err
+	}
+
+	// Hash with every algorithm that might need to be verified
+	algorithms := []string{}
+	for algorithm := range options.checksums {
+		algorithms = append(algorithms, algorithm)
+	}
+	for _, entry := range options.checksumManifest {
+		if !slices.Contains(algorithms, entry.algorithm) {
+			algorithms = append(algorithms, entry.algorithm)
+		}
+	}
+	var hashes checksumWriter
+	if len(algorithms) > 0 {
+		hashes = newChecksumWriter(algorithms)
+	}
+
+	var info downloadInfo
+	var err error
+	if options.connections > 1 || hasSegmentState(metaPath, url) {
+		info, err = downloadSegmented(ctx, url, partPath, metaPath, resolvePath, options)
+		if errors.Is(err, errSegmentsUnsupported) {
+			info, err = downloadPart(ctx, url, partPath, metaPath, hashes, resolvePath, options)
+		} else if err == nil && hashes != nil {
+			// Segments are written out of order, so the file is hashed once complete
+			err = hashFile(partPath, hashes)
+		}
+	} else {
+		info, err = downloadPart(ctx, url, partPath, metaPath, hashes, resolvePath, options)
+	}
+	info.path = filePath
+	if errors.Is(err, errDownloadSkipped) {
+		info.skipped = true
+		return info, nil
+	} else if err != nil {
+		return info, err
+	}
+
+	// Verify checksums, and delete the file when they don't match
+	if hashes != nil {
+		sums := hashes.sums()
+		expected := map[string]string{}
+		maps.Copy(expected, options.checksums)
+		var err error
+		if options.checksumManifest != nil {
+			names := []string{info.filename, urlFileName(info.finalUrl), urlFileName(url), filepath.Base(filePath)}
+			if entry, ok := findChecksumEntry(options.checksumManifest, names...); ok {
+				expected[entry.algorithm] = entry.sum
+			} else {
+				err = lib.NewError(lib.CodeChecksumMismatch, "checksum manifest has no entry for %s", filepath.Base(filePath))
+			}
+		}
+		if err == nil {
+			err = verifyChecksums(expected, sums)
+		}
+		if err != nil {
+			os.Remove(partPath)
+			os.Remove(metaPath)
+			return info, err
+		}
+
+		info.checksums = map[string]string{}
+		for algorithm := range expected {
+			info.checksums[algorithm] = sums[algorithm]
+		}
+	}
+
+	if err := os.Rename(partPath, filePath); err != nil {
+		return info, lib.WrapError(lib.CodeIO, err, "failed to move downloaded file into place")
+	}
+	os.Remove(metaPath)
+
+	return info, nil
+}
+
+// Downloads URL into partPath, resuming a previous partial download when possible.
+// Whole file, including the resumed part, is written into `hashes` when it's not nil.
+// `resolvePath` is called with a successful response before anything is written.
+func downloadPart(
+	ctx context.Context,
+	url, partPath, metaPath string,
+	hashes checksumWriter,
+	resolvePath func(resp *http.Response) error,
+	options downloadOptions,
+) (downloadInfo, error) {
+	info := downloadInfo{}
+
+	// Check if there is a partial download we can resume
+	var offset int64
+	var partial partialDownload
+	if stat, err := os.Stat(partPath); err == nil && stat.Size() > 0 {
+		if data, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(data, &partial) == nil &&
+			partial.Url == url && partial.ifRange() != "" && len(partial.Segments) == 0 {
+			offset = stat.Size()
+		}
 	}
 
 	// Make HTTP request
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch URL: %w", err)
+		return info, lib.WrapError(lib.CodeInvalidArgument, err, "failed to create request")
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", partial.ifRange())
+	}
+	resp, err := options.client.Do(req)
+	if err != nil {
+		return info, err
 	}
 	defer resp.Body.Close()
 
+	// Partial file is probably already complete, or out of sync with the server, so start over
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		os.Remove(partPath)
+		os.Remove(metaPath)
+		return downloadPart(ctx, url, partPath, metaPath, hashes, resolvePath, options)
+	}
+
 	// Check for HTTP errors
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("non-OK HTTP status: %d %s", resp.StatusCode, resp.Status)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return info, lib.HTTPStatusError(resp)
 	}
 
-	// Create the file
-	out, err := os.Create(filePath)
+	info.filename = fileNameFromResponse(resp)
+	if err := resolvePath(resp); err != nil {
+		return info, err
+	}
+
+	// Open the file. Server responds with 200 when it doesn't support ranges, or when the file has changed.
+	var out *os.File
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return info, lib.NewError(lib.CodeInvalidResponse, "unexpected Content-Range: %s", resp.Header.Get("Content-Range"))
+		}
+		if hashes != nil {
+			if err := hashFile(partPath, hashes); err != nil {
+				return info, err
+			}
+		}
+		out, err = os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+		info.resumed = true
+	} else {
+		offset = 0
+		out, err = os.Create(partPath)
+		partial = partialDownload{Url: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+		if partial.ifRange() != "" {
+			os.WriteFile(metaPath, lib.Must(lib.JSONMarshal(partial)), 0644)
+		} else {
+			os.Remove(metaPath)
+		}
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %w", err)
+		return info, lib.WrapError(lib.CodeIO, err, "failed to create file")
 	}
 	defer out.Close()
 
 	// Write response body to file
-	_, err = io.Copy(out, resp.Body)
+	writers := []io.Writer{out}
+	if hashes != nil {
+		writers = append(writers, hashes)
+	}
+	if options.progress {
+		total := resp.ContentLength
+		if total >= 0 {
+			total += offset
+		}
+		progress := lib.NewProgressWriter(ctx, total, offset)
+		defer progress.Done()
+		writers = append(writers, progress)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to write file: %w", err)
+		return info, lib.WrapCopyError(err, "failed to write file")
+	}
+	if err := out.Close(); err != nil {
+		return info, lib.WrapError(lib.CodeIO, err, "failed to write file")
 	}
 
-	// Extract file name from Content-Disposition header
-	return getFileNameFromHeader(resp.Header.Get("Content-Disposition")), nil
+	info.finalUrl = resp.Request.URL.String()
+	return info, nil
 }
 
-// Extracts the file name from the Content-Disposition header.
-func getFileNameFromHeader(header string) string {
-	if header == "" {
-		return ""
+// Path of the partial download file in directory mode, named after the URL so that it can be found when resuming.
+func directoryPartPath(dir, url string) string {
+	name := sanitizeFileName(urlFileName(url))
+	if name == "" {
+		name = defaultFileName
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%.8x.part", name, sha1.Sum([]byte(url))))
+}
+
+// Applies conflict policy to a destination path, and returns the path to download into.
+// Returns `errDownloadSkipped` when file exists and policy is `skip`.
+func resolveConflict(filePath string, policy string) (string, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return filePath, nil
 	}
 
-	const prefix = "filename="
-	for _, part := range strings.Split(header, ";") {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, prefix) {
-			// Remove the prefix and any surrounding quotes
-			return strings.Trim(part[len(prefix):], `"`)
+	switch policy {
+	case conflictSkip:
+		return filePath, errDownloadSkipped
+	case conflictFail:
+		return filePath, lib.NewError(lib.CodeFileExists, "file already exists: %s", filePath)
+	case conflictRename:
+		extension := filepath.Ext(filePath)
+		base := strings.TrimSuffix(filePath, extension)
+		for i := 1; i < 10000; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, i, extension)
+			if _, err := os.Stat(candidate); err != nil {
+				return candidate, nil
+			}
 		}
+		return filePath, lib.NewError(lib.CodeFileExists, "couldn't find a free name for: %s", filePath)
+	default:
+		return filePath, nil
+	}
+}
+
+// Writes contents of a file into `w`.
+func hashFile(filePath string, w io.Writer) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return lib.WrapError(lib.CodeIO, err, "failed to read file for hashing")
+	}
+	defer file.Close()
+	if _, err := io.Copy(w, file); err != nil {
+		return lib.WrapError(lib.CodeIO, err, "failed to read file for hashing")
+	}
+	return nil
+}
+
+// Parses the first byte position out of a `Content-Range: bytes <start>-<end>/<size>` header.
+func contentRangeStart(header string) (int64, bool) {
+	rest, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
 	}
-	return ""
+	value, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	return value, err == nil
 }
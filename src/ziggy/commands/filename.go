@@ -0,0 +1,233 @@
+package commands
+
+import (
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Name used when neither the server nor the URL suggest anything.
+const defaultFileName = "download"
+
+// Preferred extensions of common content types. `mime.ExtensionsByType` depends on the
+// system's mime database, and returns alphabetically sorted lists like `.jfif, .jpe, .jpeg, .jpg`.
+var contentTypeExtensions = map[string]string{
+	"application/gzip":         ".gz",
+	"application/json":         ".json",
+	"application/octet-stream": "",
+	"application/pdf":          ".pdf",
+	"application/x-subrip":     ".srt",
+	"application/zip":          ".zip",
+	"audio/flac":               ".flac",
+	"audio/mp4":                ".m4a",
+	"audio/mpeg":               ".mp3",
+	"audio/ogg":                ".ogg",
+	"image/gif":                ".gif",
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/webp":               ".webp",
+	"text/html":                ".html",
+	"text/plain":               ".txt",
+	"text/vtt":                 ".vtt",
+	"video/mp4":                ".mp4",
+	"video/webm":               ".webm",
+	"video/x-matroska":         ".mkv",
+}
+
+// Windows reserved device names, which can't be used as file names with any extension.
+var reservedFileNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Picks a safe file name for a response. Prefers the Content-Disposition header, then the
+// last segment of the final URL path after redirects. Extension is added based on Content-Type
+// when the name has none.
+func fileNameFromResponse(resp *http.Response) string {
+	name := getFileNameFromHeader(resp.Header.Get("Content-Disposition"))
+	if name == "" && resp.Request != nil {
+		name = sanitizeFileName(urlFileName(resp.Request.URL.String()))
+	}
+	if name == "" {
+		name = defaultFileName
+	}
+	if path.Ext(name) == "" {
+		name += contentTypeExtension(resp.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// Extracts a sanitized file name from the Content-Disposition header (RFC 6266).
+// Encoded `filename*` parameter (RFC 5987) takes precedence over `filename`.
+func getFileNameFromHeader(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	// `filename*` is always decoded by our own parser, as `mime.ParseMediaType` silently drops it
+	// in charsets other than UTF-8, and merges it into `filename` even when it's invalid
+	params := parseDispositionParams(header)
+	if name := params["filename*"]; name != "" {
+		return sanitizeFileName(name)
+	}
+
+	// Own parser is also a fallback for headers `mime` refuses, like unquoted names with spaces
+	if !strings.Contains(strings.ToLower(header), "filename*") {
+		if _, parsed, err := mime.ParseMediaType(header); err == nil {
+			params = parsed
+		}
+	}
+	return sanitizeFileName(params["filename"])
+}
+
+// Lenient parser of Content-Disposition parameters. Returns lowercased parameter names,
+// with `filename*` already decoded, or missing when it can't be.
+func parseDispositionParams(header string) map[string]string {
+	params := map[string]string{}
+
+	for _, part := range splitQuoted(header, ';') {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "filename*" {
+			if decoded, ok := decodeExtValue(value); ok {
+				params[key] = decoded
+			}
+		} else {
+			params[key] = unquote(value)
+		}
+	}
+	return params
+}
+
+// Splits a string on a separator that is not inside double quotes.
+func splitQuoted(str string, separator rune) []string {
+	parts := []string{}
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, char := range str {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && char == '\\':
+			escaped = true
+		case char == '"':
+			quoted = !quoted
+		case !quoted && char == separator:
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(char)
+	}
+	return append(parts, current.String())
+}
+
+// Removes surrounding quotes and backslash escapes from a quoted-string.
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var result strings.Builder
+	escaped := false
+	for _, char := range value[1 : len(value)-1] {
+		if !escaped && char == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		result.WriteRune(char)
+	}
+	return result.String()
+}
+
+// Decodes an RFC 5987 `charset'language'percent-encoded` value. Supports UTF-8 and ISO-8859-1.
+func decodeExtValue(value string) (string, bool) {
+	parts := strings.SplitN(unquote(value), "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	decoded, err := neturl.PathUnescape(parts[2])
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "utf-8":
+		return decoded, utf8.ValidString(decoded)
+	case "iso-8859-1":
+		runes := make([]rune, 0, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes = append(runes, rune(decoded[i]))
+		}
+		return string(runes), true
+	default:
+		return "", false
+	}
+}
+
+// Makes a name suggested by a server safe to use as a file name on any OS.
+// Strips directory components, and removes characters illegal on Windows.
+// Returns empty string when nothing usable remains.
+func sanitizeFileName(name string) string {
+	// Strip directory components of both path flavors
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(char rune) rune {
+		if unicode.IsControl(char) || strings.ContainsRune(`<>:"|?*`, char) {
+			return -1
+		}
+		return char
+	}, name)
+
+	// Windows doesn't allow trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return ""
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	for _, reserved := range reservedFileNames {
+		if strings.EqualFold(strings.TrimSpace(base), reserved) {
+			name = "_" + name
+			break
+		}
+	}
+
+	return name
+}
+
+// Last segment of the URL path.
+func urlFileName(rawUrl string) string {
+	parsed, err := neturl.Parse(rawUrl)
+	if err != nil || parsed.Path == "" {
+		return ""
+	}
+	return path.Base(parsed.Path)
+}
+
+// Extension for a Content-Type header, or empty string when unknown.
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if extension, ok := contentTypeExtensions[mediaType]; ok {
+		return extension
+	}
+	if extensions, err := mime.ExtensionsByType(mediaType); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package commands
+
+import "testing"
+
+func TestGetFileNameFromHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{``, ``},
+		{`attachment`, ``},
+		{`attachment; filename="movie.srt"`, `movie.srt`},
+		{`attachment; filename=movie.srt`, `movie.srt`},
+		{`attachment; filename=my movie.srt`, `my movie.srt`},
+		{`attachment; filename="a;b.srt"; size=10`, `a;b.srt`},
+		{`attachment; filename="say \"hi\".srt"`, `say hi.srt`},
+		{`ATTACHMENT; FILENAME="upper.srt"`, `upper.srt`},
+		{`attachment; FileName="mixed.srt"`, `mixed.srt`},
+		{`attachment; filename*=UTF-8''%E2%82%AC%20rates.txt`, `€ rates.txt`},
+		{`attachment; filename*=utf-8'en'caf%C3%A9.txt`, `café.txt`},
+		{`attachment; filename*=iso-8859-1'en'caf%E9.txt`, `café.txt`},
+		{`attachment; FILENAME*=ISO-8859-1''caf%E9.txt`, `café.txt`},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''preferred.txt`, `preferred.txt`},
+		{`attachment; filename*=UTF-8''preferred.txt; filename="fallback.txt"`, `preferred.txt`},
+		{`attachment; filename="fallback.txt"; filename*=koi8-r''%C1.txt`, `fallback.txt`},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''%FF.txt`, `fallback.txt`},
+		{`attachment; filename="../../etc/passwd"`, `passwd`},
+		{`attachment; filename="..\\..\\evil.exe"`, `evil.exe`},
+		{`attachment; filename*=UTF-8''..%2F..%2Fevil.srt`, `evil.srt`},
+		{`attachment; filename=".."`, ``},
+		{`attachment; filename="CON.srt"`, `_CON.srt`},
+	}
+	for _, test := range tests {
+		if got := getFileNameFromHeader(test.header); got != test.want {
+			t.Errorf("getFileNameFromHeader(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{``, ``},
+		{`movie.srt`, `movie.srt`},
+		{`dir/sub/movie.srt`, `movie.srt`},
+		{`dir\sub\movie.srt`, `movie.srt`},
+		{`../movie.srt`, `movie.srt`},
+		{`..`, ``},
+		{`dir/`, ``},
+		{`a<b>c:d"e|f?g*.srt`, `abcdefg.srt`},
+		{"tab\there\x00.srt", `tabhere.srt`},
+		{`trailing. . `, `trailing`},
+		{`  spaced.srt  `, `spaced.srt`},
+		{`CON`, `_CON`},
+		{`con.txt`, `_con.txt`},
+		{`Nul.tar.gz`, `_Nul.tar.gz`},
+		{`lpt9.srt`, `_lpt9.srt`},
+		{`COM10.srt`, `COM10.srt`},
+		{`console.srt`, `console.srt`},
+		{`café €.srt`, `café €.srt`},
+	}
+	for _, test := range tests {
+		if got := sanitizeFileName(test.name); got != test.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
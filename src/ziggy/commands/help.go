@@ -0,0 +1,227 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+// Set during build with `-ldflags "-X uosc/bins/src/ziggy/commands.Version=<version>"`.
+var Version = "dev"
+
+type CapabilitiesResult struct {
+	Name     string           `json:"name"`
+	Version  string           `json:"version"`
+	Build    BuildInfo        `json:"build"`
+	Commands []CommandCatalog `json:"commands"`
+}
+
+type BuildInfo struct {
+	Go       string `json:"go"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Revision string `json:"revision,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Modified bool   `json:"modified"`
+}
+
+type CommandCatalog struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Arguments   string        `json:"arguments,omitempty"`
+	Flags       []FlagCatalog `json:"flags"`
+	Result      any           `json:"result"` // Result schema, `"any"` when opaque.
+}
+
+type FlagCatalog struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Default     string `json:"default"`
+	Description string `json:"description"`
+}
+
+func newHelpFlags() *flag.FlagSet {
+	return flag.NewFlagSet("help", flag.ContinueOnError)
+}
+
+func newCapabilitiesFlags() *flag.FlagSet {
+	return flag.NewFlagSet("capabilities", flag.ContinueOnError)
+}
+
+func Help(_ context.Context, args []string) any {
+	cmd := newHelpFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
+
+	values := cmd.Args()
+	if len(values) > 1 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "only one command name expected, but %v received", len(values)))
+	}
+
+	// Help for a single command
+	if len(values) == 1 {
+		command, ok := Find(values[0])
+		if !ok {
+			lib.Check(lib.NewError(lib.CodeUnknownCommand, "unknown command: %s", values[0]))
+		}
+
+		var text strings.Builder
+		fmt.Fprintf(&text, "%s\n\nUsage:\n\n  ziggy %s [flags]", command.Description, command.Name)
+		if command.Arguments != "" {
+			fmt.Fprintf(&text, " %s", command.Arguments)
+		}
+		text.WriteString("\n")
+
+		flags := command.Flags()
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			text.WriteString("\nFlags:\n\n")
+			flags.SetOutput(&text)
+			flags.PrintDefaults()
+		}
+
+		return Text(text.String())
+	}
+
+	// List of all commands
+	width := 0
+	for _, command := range registry {
+		width = max(width, len(command.Name))
+	}
+
+	var text strings.Builder
+	text.WriteString("ziggy - uosc's multitool binary.\n\nUsage:\n\n  ziggy <command> [flags] [args]\n\nAvailable <command>s:\n\n")
+	for _, command := range registry {
+		fmt.Fprintf(&text, "  %-*s  %s\n", width, command.Name, command.Description)
+	}
+	text.WriteString("\nRun 'ziggy help <command>' for help on how to use each command.\n")
+
+	return Text(text.String())
+}
+
+func Capabilities(_ context.Context, args []string) any {
+	lib.Check(lib.ParseFlags(newCapabilitiesFlags(), args))
+
+	result := CapabilitiesResult{
+		Name:    "ziggy",
+		Version: Version,
+		Build: BuildInfo{
+			Go:   runtime.Version(),
+			OS:   runtime.GOOS,
+			Arch: runtime.GOARCH,
+		},
+		Commands: []CommandCatalog{},
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				result.Build.Revision = setting.Value
+			case "vcs.time":
+				result.Build.Time = setting.Value
+			case "vcs.modified":
+				result.Build.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	for _, command := range registry {
+		catalog := CommandCatalog{
+			Name:        command.Name,
+			Description: command.Description,
+			Arguments:   command.Arguments,
+			Flags:       []FlagCatalog{},
+			Result:      schemaOf(reflect.TypeOf(command.Result)),
+		}
+		command.Flags().VisitAll(func(f *flag.Flag) {
+			catalog.Flags = append(catalog.Flags, FlagCatalog{
+				Name:        f.Name,
+				Type:        flagType(f),
+				Default:     f.DefValue,
+				Description: f.Usage,
+			})
+		})
+		result.Commands = append(result.Commands, catalog)
+	}
+
+	return result
+}
+
+// Name of the type of value a flag accepts.
+func flagType(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "string"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "bool"
+	case int, int64, uint, uint64:
+		return "int"
+	case float64:
+		return "float"
+	case time.Duration:
+		return "duration"
+	case []string:
+		return "string[]"
+	default:
+		return "string"
+	}
+}
+
+// Describes the JSON shape of a type. Structs become objects of their JSON field schemas,
+// slices become one item arrays, and everything else is a type name.
+func schemaOf(t reflect.Type) any {
+	if t == nil || t == reflect.TypeOf(json.RawMessage{}) {
+		return "any"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.Struct:
+		fields := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = schemaOf(field.Type)
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		return []any{schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"*": schemaOf(t.Elem())}
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	default:
+		return "any"
+	}
+}
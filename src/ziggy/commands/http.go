@@ -2,77 +2,504 @@ package commands
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"uosc/bins/src/ziggy/lib"
 )
 
 type HTTPResult struct {
-	Headers http.Header `json:"headers"`
-	Status  int         `json:"status"`
-	Body    string      `json:"body"`
+	Headers      http.Header `json:"headers"`
+	Status       int         `json:"status"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body_encoding"`    // `text` or `base64`. Empty when body was written into `--output`.
+	Output       string      `json:"output,omitempty"` // Path of the file the body was written into.
+	Size         int64       `json:"size"`             // Size of the body in bytes.
+	FromCache    bool        `json:"from_cache"`       // Response was served from `--cache-dir`.
+	Truncated    bool        `json:"truncated"`        // Body was cut at `--max-body-bytes`.
+	FinalUrl     string      `json:"final_url"`        // URL of the response after following redirects.
+	// Redirects followed on the way to the response. With `--no-follow`, the redirect response itself is the result.
+	Redirects []lib.Redirect `json:"redirects"`
+	// Body parsed with `--parse-json`, so callers don't have to decode it from a string again.
+	JSON       json.RawMessage `json:"json,omitempty"`
+	ParseError string          `json:"parse_error,omitempty"` // Why the body couldn't be parsed with `--parse-json`.
 }
 
-func Http(method string, args []string) {
-	cmd := flag.NewFlagSet("http-get", flag.ExitOnError)
-	argHeaders := cmd.String("headers", "", "HTTP GET headers as JSON.")
-	argBody := cmd.String("body", "", "HTTP GET body.")
-	defaultHeaders := map[string]string{
-		"User-Agent": "uosc/ziggy",
-		"Accept":     "application/json",
+// Bodies larger than this are truncated unless `--max-body-bytes` says otherwise.
+const defaultMaxBodyBytes = 8 << 20 // 8 MiB
+
+// How response body is put into `HTTPResult.Body`.
+const (
+	bodyEncodingAuto   = "auto" // Text for textual content types that are valid UTF-8, base64 otherwise.
+	bodyEncodingText   = "text"
+	bodyEncodingBase64 = "base64"
+)
+
+type httpFlags struct {
+	method       *string // Only defined by the generic `http` command.
+	headers      *string
+	query        *string
+	body         *string
+	bodyFile     *string
+	bodyStdin    *bool
+	json         *bool
+	form         *lib.StringList
+	formFile     *lib.StringList
+	output       *string
+	bodyEncoding *string
+	parseJson    *bool
+	maxBodyBytes *int64
+	cacheDir     *string
+	maxRedirects *int
+	noFollow     *bool
+	client       lib.ClientFlags
+}
+
+// Creates flags of the `http-<method>` command, or of the generic `http` command when method is empty.
+func newHttpFlags(method string) (*flag.FlagSet, httpFlags) {
+	name, label := "http-"+strings.ToLower(method), "HTTP "+method
+	if method == "" {
+		name, label = "http", "HTTP request"
+	}
+	cmd := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags := httpFlags{
+		headers:      cmd.String("headers", "", label+` headers as JSON object. Values can be strings or arrays of strings, e.g.: {"Accept": ["text/html", "*/*"]}`),
+		query:        cmd.String("query", "", `Query parameters as JSON object to add to the URL. Values can be strings, numbers, booleans, or arrays of them.`),
+		body:         cmd.String("body", "", label+" body."),
+		bodyFile:     cmd.String("body-file", "", "Read request body from a file."),
+		bodyStdin:    cmd.Bool("body-stdin", false, "Read request body from stdin."),
+		json:         cmd.Bool("json", false, "Request body is JSON. Validates it and sets Content-Type."),
+		form:         lib.StringListFlag(cmd, "form", "Multipart form field as key=value. Can be repeated."),
+		formFile:     lib.StringListFlag(cmd, "form-file", "Multipart form file as field=@path. Can be repeated."),
+		output:       cmd.String("output", "", "Write response body into this file instead of the result."),
+		bodyEncoding: cmd.String("body-encoding", bodyEncodingAuto, "How to encode response body in the result: auto, text, or base64."),
+		maxBodyBytes: cmd.Int64("max-body-bytes", defaultMaxBodyBytes, "Truncate response body in the result at this size. 0 disables the limit. Doesn't apply to --output."),
+		cacheDir:     cmd.String("cache-dir", "", "Cache GET responses in this directory, and revalidate them with the server."),
+		maxRedirects: cmd.Int("max-redirects", lib.DefaultMaxRedirects, "How many redirects to follow before failing."),
+		noFollow:     cmd.Bool("no-follow", false, "Don't follow redirects, and return the redirect response instead."),
+		client:       lib.DefineClientFlags(cmd),
+		parseJson:    cmd.Bool("parse-json", false, "Parse response body as JSON into the json property of the result."),
+	}
+	if method == "" {
+		flags.method = cmd.String("method", "GET", "HTTP method, e.g.: GET, HEAD, OPTIONS, POST.")
+	}
+	return cmd, flags
+}
+
+func Http(ctx context.Context, method string, args []string) any {
+	cmd, flags := newHttpFlags(method)
+	headers := http.Header{
+		"User-Agent": {"uosc/ziggy"},
+		"Accept":     {"application/json"},
 	}
 
-	lib.Check(cmd.Parse(args))
+	lib.Check(lib.ParseFlags(cmd, args))
+
+	// Method characters are validated when creating the request
+	if flags.method != nil {
+		if *flags.method == "" {
+			lib.Check(lib.MissingArgument("method"))
+		}
+		method = strings.ToUpper(*flags.method)
+	}
 
 	values := cmd.Args()
 	if len(values) < 1 {
-		lib.Check(errors.New("missing URL parameter"))
+		lib.Check(lib.NewError(lib.CodeMissingArgument, "missing URL parameter"))
 	}
 	if len(values) > 1 {
-		lib.Check(fmt.Errorf("multiple URL parameters received: %v", values))
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "multiple URL parameters received: %v", values))
 	}
 
-	url := values[0]
+	requestUrl := values[0]
+	client := lib.Must(flags.client.Client())
 
-	// Process JSON headers
-	headers := defaultHeaders
-	if argHeaders != nil && *argHeaders != "" {
-		customHeaders := make(map[string]string)
-		lib.Check(json.Unmarshal([]byte(*argHeaders), &customHeaders))
+	if !slices.Contains([]string{bodyEncodingAuto, bodyEncodingText, bodyEncodingBase64}, *flags.bodyEncoding) {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--body-encoding has to be one of: auto, text, base64"))
+	}
+	if *flags.parseJson && len(*flags.output) > 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--parse-json can't be used with --output"))
+	}
+	if *flags.maxBodyBytes < 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--max-body-bytes can't be negative"))
+	}
+	if *flags.maxRedirects < 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--max-redirects can't be negative"))
+	}
+	redirectPolicy := ""
+	if *flags.noFollow {
+		client = client.WithoutRedirects()
+		redirectPolicy = "no-follow"
+	} else if *flags.maxRedirects != lib.DefaultMaxRedirects {
+		client = client.WithMaxRedirects(*flags.maxRedirects)
+		redirectPolicy = strconv.Itoa(*flags.maxRedirects)
+	}
+	if len(*flags.cacheDir) > 0 && method != "GET" {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--cache-dir can only be used with GET requests"))
+	}
+	if len(*flags.cacheDir) > 0 && len(*flags.output) > 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--cache-dir can't be used with --output"))
+	}
 
-		for key, value := range customHeaders {
-			headers[key] = value
+	// Process JSON headers
+	if *flags.headers != "" {
+		customHeaders, err := jsonValueLists(*flags.headers)
+		if err != nil {
+			lib.Check(lib.WrapError(lib.CodeInvalidArgument, err, "invalid --headers"))
+		}
+		for key, values := range customHeaders {
+			headers[http.CanonicalHeaderKey(key)] = values
 		}
 	}
 
-	// Set up the request body if provided
-	var bodyReader *bytes.Reader
-	if argBody != nil {
-		bodyReader = bytes.NewReader([]byte(*argBody))
-	} else {
-		bodyReader = bytes.NewReader(nil)
+	// Add query parameters, keeping the existing query as is
+	if *flags.query != "" {
+		params, err := jsonValueLists(*flags.query)
+		if err != nil {
+			lib.Check(lib.WrapError(lib.CodeInvalidArgument, err, "invalid --query"))
+		}
+		parsedUrl, err := url.Parse(requestUrl)
+		if err != nil {
+			lib.Check(lib.WrapError(lib.CodeInvalidArgument, err, "invalid URL"))
+		}
+		if query := url.Values(params).Encode(); query != "" {
+			if parsedUrl.RawQuery != "" {
+				parsedUrl.RawQuery += "&"
+			}
+			parsedUrl.RawQuery += query
+		}
+		requestUrl = parsedUrl.String()
 	}
 
 	// Create an HTTP request
-	req := lib.Must(http.NewRequest(method, url, bodyReader))
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	payload := lib.Must(requestBody(ctx, flags))
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, payload.reader)
+	if err != nil {
+		lib.Check(lib.WrapError(lib.CodeInvalidArgument, err, "invalid request"))
+	}
+	req.ContentLength = payload.length
+	req.Header = headers
+	if payload.contentType != "" {
+		req.Header.Set("Content-Type", payload.contentType)
 	}
 
-	// Create an HTTP client and make the request
-	client := &http.Client{}
-	resp := lib.Must(client.Do(req))
+	// Make the request, or answer it from cache
+	var resp *http.Response
+	fromCache := false
+	if len(*flags.cacheDir) > 0 {
+		resp, fromCache, err = httpCache{dir: *flags.cacheDir, maxBodyBytes: *flags.maxBodyBytes, redirectPolicy: redirectPolicy}.do(client, req)
+		lib.Check(err)
+	} else {
+		resp = lib.Must(client.Do(req))
+	}
 	defer resp.Body.Close()
 
-	// Output the response
-	fmt.Print(string(lib.Must(lib.JSONMarshal(HTTPResult{
-		Status:  resp.StatusCode,
-		Headers: resp.Header,
-		Body:    string(lib.Must(io.ReadAll(resp.Body))),
-	}))))
+	result := HTTPResult{
+		Status:    resp.StatusCode,
+		Headers:   resp.Header,
+		FromCache: fromCache,
+		FinalUrl:  resp.Request.URL.String(),
+		Redirects: lib.Redirects(resp),
+	}
+
+	// Stream the body into a file
+	if len(*flags.output) > 0 {
+		result.Output = *flags.output
+		result.Size = lib.Must(writeBodyToFile(resp.Body, *flags.output))
+		return result
+	}
+
+	body, truncated, err := readBody(resp.Body, *flags.maxBodyBytes)
+	if err != nil {
+		lib.Check(lib.WrapCopyError(err, "failed to read response body"))
+	}
+
+	result.Size = int64(len(body))
+	result.Truncated = truncated
+	contentType := resp.Header.Get("Content-Type")
+	if *flags.bodyEncoding != bodyEncodingBase64 {
+		body = decodeTextBody(body, contentType, truncated)
+	}
+	result.Body, result.BodyEncoding = encodeBody(body, contentType, *flags.bodyEncoding)
+
+	if *flags.parseJson {
+		var parsed json.RawMessage
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			result.ParseError = err.Error()
+		} else {
+			result.JSON = parsed
+		}
+	}
+
+	return result
+}
+
+// Decodes a JSON object whose values are strings, numbers, booleans, or arrays of them, into lists of strings.
+func jsonValueLists(data string) (map[string][]string, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(data), &object); err != nil {
+		return nil, err
+	}
+
+	lists := map[string][]string{}
+	for key, raw := range object {
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			items = []json.RawMessage{raw}
+		}
+		for _, item := range items {
+			var value any
+			if err := json.Unmarshal(item, &value); err != nil {
+				return nil, err
+			}
+			switch value := value.(type) {
+			case string:
+				lists[key] = append(lists[key], value)
+			case float64, bool:
+				lists[key] = append(lists[key], string(bytes.TrimSpace(item)))
+			default:
+				return nil, fmt.Errorf("value of %s has to be a string, number, boolean, or an array of them", key)
+			}
+		}
+	}
+	return lists, nil
+}
+
+type httpRequestBody struct {
+	reader      io.Reader
+	length      int64 // -1 when unknown.
+	contentType string
+	multipart   bool
+}
+
+// Creates request body from whichever body flag was used.
+func requestBody(ctx context.Context, flags httpFlags) (httpRequestBody, error) {
+	sources := 0
+	for _, used := range []bool{
+		len(*flags.body) > 0,
+		len(*flags.bodyFile) > 0,
+		*flags.bodyStdin,
+		len(*flags.form) > 0 || len(*flags.formFile) > 0,
+	} {
+		if used {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "only one of --body, --body-file, --body-stdin, or --form/--form-file can be used")
+	}
+
+	if len(*flags.form) > 0 || len(*flags.formFile) > 0 {
+		if *flags.json {
+			return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "--json can't be used with --form")
+		}
+		return multipartBody(*flags.form, *flags.formFile)
+	}
+
+	var data []byte
+	switch {
+	case len(*flags.bodyFile) > 0:
+		file, err := os.Open(*flags.bodyFile)
+		if err != nil {
+			return httpRequestBody{}, lib.WrapError(lib.CodeIO, err, "failed to open --body-file")
+		}
+		// Stream the file unless it has to be validated
+		if !*flags.json {
+			stat, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return httpRequestBody{}, lib.WrapError(lib.CodeIO, err, "failed to read --body-file")
+			}
+			return httpRequestBody{reader: file, length: stat.Size()}, nil
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return httpRequestBody{}, lib.WrapError(lib.CodeIO, err, "failed to read --body-file")
+		}
+	case *flags.bodyStdin:
+		if !lib.StdinAvailable(ctx) {
+			return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "--body-stdin is not available in serve mode")
+		}
+		var err error
+		if data, err = io.ReadAll(os.Stdin); err != nil {
+			return httpRequestBody{}, lib.WrapError(lib.CodeIO, err, "failed to read stdin")
+		}
+	default:
+		data = []byte(*flags.body)
+	}
+
+	body := httpRequestBody{reader: bytes.NewReader(data), length: int64(len(data))}
+	if *flags.json {
+		if !json.Valid(data) {
+			return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "request body is not valid JSON")
+		}
+		body.contentType = "application/json"
+	}
+	return body, nil
+}
+
+// Streams a multipart/form-data body with `key=value` fields and `field=@path` files.
+func multipartBody(fields []string, files []string) (httpRequestBody, error) {
+	type formFile struct{ field, path string }
+	formFiles := []formFile{}
+	for _, value := range files {
+		field, filePath, ok := strings.Cut(value, "=@")
+		if !ok || field == "" || filePath == "" {
+			return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "--form-file has to be in field=@path format: %s", value)
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			return httpRequestBody{}, lib.WrapError(lib.CodeIO, err, "invalid --form-file")
+		}
+		formFiles = append(formFiles, formFile{field, filePath})
+	}
+	for _, value := range fields {
+		if key, _, ok := strings.Cut(value, "="); !ok || key == "" {
+			return httpRequestBody{}, lib.NewError(lib.CodeInvalidArgument, "--form has to be in key=value format: %s", value)
+		}
+	}
+
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		writer.CloseWithError(func() error {
+			for _, value := range fields {
+				key, value, _ := strings.Cut(value, "=")
+				if err := form.WriteField(key, value); err != nil {
+					return err
+				}
+			}
+			for _, file := range formFiles {
+				part, err := form.CreateFormFile(file.field, filepath.Base(file.path))
+				if err != nil {
+					return err
+				}
+				in, err := os.Open(file.path)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(part, in)
+				in.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return form.Close()
+		}())
+	}()
+
+	return httpRequestBody{reader: reader, length: -1, contentType: form.FormDataContentType(), multipart: true}, nil
+}
+
+// Writes body into a file. File only appears at filePath once the whole body was received.
+func writeBodyToFile(body io.Reader, filePath string) (int64, error) {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, lib.WrapError(lib.CodeIO, err, "failed to create directory %s", dir)
+	}
+
+	partPath := filePath + ".part"
+	out, err := os.Create(partPath)
+	if err != nil {
+		return 0, lib.WrapError(lib.CodeIO, err, "failed to create file")
+	}
+	defer os.Remove(partPath)
+	defer out.Close()
+
+	size, err := io.Copy(out, body)
+	if err != nil {
+		return size, lib.WrapCopyError(err, "failed to write file")
+	}
+	if err := out.Close(); err != nil {
+		return size, lib.WrapError(lib.CodeIO, err, "failed to write file")
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return size, lib.WrapError(lib.CodeIO, err, "failed to move file into place")
+	}
+
+	return size, nil
+}
+
+// Encodes body for the JSON result. Returns the body and the encoding used.
+func encodeBody(body []byte, contentType string, encoding string) (string, string) {
+	if encoding == bodyEncodingAuto {
+		encoding = bodyEncodingBase64
+		if (contentType == "" || isTextContentType(contentType)) && utf8.Valid(body) {
+			encoding = bodyEncodingText
+		}
+	}
+
+	if encoding == bodyEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(body), bodyEncodingBase64
+	}
+	return string(body), bodyEncodingText
+}
+
+// Reads at most `limit` bytes of body, reporting whether there was more. Limit 0 reads everything.
+func readBody(body io.Reader, limit int64) ([]byte, bool, error) {
+	if limit == 0 {
+		data, err := io.ReadAll(body)
+		return data, false, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if int64(len(data)) > limit {
+		return data[:limit], true, err
+	}
+	return data, false, err
+}
+
+// Converts textual body into UTF-8 according to the charset in Content-Type header.
+// Bodies of other types, or in unsupported charsets, are returned unchanged.
+// UTF-8 character cut in half by truncation is dropped, so that the body stays valid text.
+func decodeTextBody(body []byte, contentType string, truncated bool) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !isTextContentType(contentType) {
+		return body
+	}
+	decoded, _ := lib.DecodeCharset(body, params["charset"])
+	if truncated {
+		for i := 1; i <= min(utf8.UTFMax-1, len(decoded)); i++ {
+			if utf8.RuneStart(decoded[len(decoded)-i]) {
+				if !utf8.FullRune(decoded[len(decoded)-i:]) {
+					decoded = decoded[:len(decoded)-i]
+				}
+				break
+			}
+		}
+	}
+	return decoded
+}
+
+// Whether Content-Type header describes a textual format.
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	return slices.Contains([]string{
+		"application/json",
+		"application/javascript",
+		"application/ecmascript",
+		"application/xml",
+		"application/x-www-form-urlencoded",
+		"application/x-subrip",
+		"image/svg+xml",
+	}, mediaType)
 }
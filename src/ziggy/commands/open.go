@@ -1,8 +1,8 @@
 package commands
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"uosc/bins/src/ziggy/lib"
 
 	"github.com/pkg/browser"
@@ -12,20 +12,26 @@ type OpenResult struct {
 	Payload string `json:"payload"`
 }
 
-func Open(args []string) {
-	cmd := flag.NewFlagSet("open", flag.ExitOnError)
+func newOpenFlags() *flag.FlagSet {
+	return flag.NewFlagSet("open", flag.ContinueOnError)
+}
+
+func Open(_ context.Context, args []string) any {
+	cmd := newOpenFlags()
 
-	lib.Check(cmd.Parse(args))
+	lib.Check(lib.ParseFlags(cmd, args))
 
 	values := cmd.Args()
 	if len(values) != 1 {
-		lib.Check(fmt.Errorf("only one path or URL expected, but %v received", len(values)))
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "only one path or URL expected, but %v received", len(values)))
 	}
 	value := values[0]
 
-	lib.Check(browser.OpenURL(value))
+	if err := browser.OpenURL(value); err != nil {
+		lib.Check(lib.WrapError(lib.CodeUnavailable, err, "failed to open"))
+	}
 
-	fmt.Print(string(lib.Must(lib.JSONMarshal(ClipboardResult{
+	return OpenResult{
 		Payload: value,
-	}))))
+	}
 }
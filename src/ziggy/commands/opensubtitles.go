@@ -0,0 +1,521 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+// Default API URL. Logged in accounts may be assigned a different host.
+const OPEN_SUBTITLES_API_URL = "https://api.opensubtitles.com/api/v1"
+
+// Assumed lifetime of a login token that doesn't state its expiration.
+const openSubtitlesTokenLifetime = 24 * time.Hour
+
+type DownloadRequestData struct {
+	FileId int `json:"file_id"`
+}
+
+type DownloadResponseData struct {
+	Link         string `json:"link"`
+	FileName     string `json:"file_name"`
+	Requests     int    `json:"requests"`
+	Remaining    int    `json:"remaining"`
+	Message      string `json:"message"`
+	ResetTime    string `json:"reset_time"`
+	ResetTimeUTC string `json:"reset_time_utc"`
+}
+
+// Subset of the `/subtitles` response that is normalized into `SubtitleSearchResult`.
+type openSubtitlesSearchResponse struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+	TotalCount int `json:"total_count"`
+	PerPage    int `json:"per_page"`
+	Data       []struct {
+		Id         string `json:"id"`
+		Attributes struct {
+			Release          string  `json:"release"`
+			Language         string  `json:"language"`
+			HearingImpaired  bool    `json:"hearing_impaired"`
+			ForeignPartsOnly bool    `json:"foreign_parts_only"`
+			MovieHashMatch   bool    `json:"moviehash_match"`
+			DownloadCount    int     `json:"download_count"`
+			Ratings          float64 `json:"ratings"`
+			Fps              float64 `json:"fps"`
+			Url              string  `json:"url"`
+			Uploader         struct {
+				Name string `json:"name"`
+			} `json:"uploader"`
+			Files []struct {
+				FileId   int    `json:"file_id"`
+				FileName string `json:"file_name"`
+			} `json:"files"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// Fields of download and error responses describing the download quota.
+type openSubtitlesQuotaResponse struct {
+	Requests     *int     `json:"requests"`
+	Remaining    *int     `json:"remaining"`
+	Message      string   `json:"message"`
+	ResetTimeUTC string   `json:"reset_time_utc"`
+	Errors       []string `json:"errors"`
+}
+
+type openSubtitlesLoginResponse struct {
+	User struct {
+		AllowedDownloads int    `json:"allowed_downloads"`
+		Level            string `json:"level"`
+		Vip              bool   `json:"vip"`
+	} `json:"user"`
+	BaseUrl string `json:"base_url"`
+	Token   string `json:"token"`
+}
+
+// Provider for the Open Subtitles REST API.
+type openSubtitles struct {
+	subtitleProviderOptions
+}
+
+func newOpenSubtitles(options subtitleProviderOptions) SubtitleProvider {
+	return &openSubtitles{options}
+}
+
+func (p *openSubtitles) Capabilities() SubtitleCapabilities {
+	return SubtitleCapabilities{Hash: true, Query: true, Languages: true, Pagination: true, ApiKey: true, Login: true}
+}
+
+func (p *openSubtitles) validate() error {
+	if len(p.apiKey) == 0 {
+		return lib.MissingArgument("api-key")
+	}
+	if len(p.agent) == 0 {
+		return lib.MissingArgument("agent")
+	}
+	if p.apiUrl != "" {
+		if u, err := url.Parse(p.apiUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return lib.NewError(lib.CodeInvalidArgument, "invalid --api-url: %s", p.apiUrl)
+		}
+	}
+	return nil
+}
+
+// Explicit `--api-url` wins over the host assigned to the logged in account, which wins over the default.
+func (p *openSubtitles) apiBase(session *subtitleSession) string {
+	switch {
+	case p.apiUrl != "":
+		return strings.TrimRight(p.apiUrl, "/")
+	case session != nil && strings.Contains(session.BaseUrl, "://"):
+		return strings.TrimRight(session.BaseUrl, "/")
+	case session != nil && session.BaseUrl != "":
+		// Login returns just the host, e.g.: vip-api.opensubtitles.com
+		return "https://" + session.BaseUrl + "/api/v1"
+	}
+	return OPEN_SUBTITLES_API_URL
+}
+
+func (p *openSubtitles) Search(ctx context.Context, query SubtitleQuery) (SubtitleSearchResult, error) {
+	result := SubtitleSearchResult{Provider: "opensubtitles", Items: []Subtitle{}}
+	if err := p.validate(); err != nil {
+		return result, err
+	}
+
+	// "Send request parameters sorted, and send all queries in lowercase."
+	params := []string{}
+	languages := slices.Clone(query.Languages)
+	slices.Sort(languages)
+	params = append(params, "languages="+escapeParam(strings.Join(languages, ",")))
+	if len(query.FilePath) > 0 {
+		hash, err := lib.OSDBHashFile(query.FilePath)
+		if err == nil {
+			params = append(params, "moviehash="+escapeParam(hash))
+		} else if len(query.Query) == 0 {
+			return result, fmt.Errorf("couldn't hash the file (%w) and query is empty", err)
+		}
+	}
+	params = append(params, "page="+escapeParam(fmt.Sprint(query.Page)))
+	if len(query.Query) > 0 {
+		params = append(params, "query="+escapeParam(query.Query))
+	}
+
+	resp, err := p.request(ctx, "GET", "/subtitles?"+strings.Join(params, "&"), nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, openSubtitlesError(resp)
+	}
+
+	var response openSubtitlesSearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return result, lib.WrapError(lib.CodeInvalidResponse, err, "couldn't parse search response")
+	}
+
+	result.Page = response.Page
+	result.TotalPages = response.TotalPages
+	result.TotalCount = response.TotalCount
+	result.PerPage = response.PerPage
+	result.Quota = openSubtitlesQuota(resp.Header, openSubtitlesQuotaResponse{})
+	for _, item := range response.Data {
+		attributes := item.Attributes
+		subtitle := Subtitle{
+			Id:               item.Id,
+			Release:          attributes.Release,
+			Language:         attributes.Language,
+			HearingImpaired:  attributes.HearingImpaired,
+			ForeignPartsOnly: attributes.ForeignPartsOnly,
+			HashMatch:        attributes.MovieHashMatch,
+			Downloads:        attributes.DownloadCount,
+			Rating:           attributes.Ratings,
+			Fps:              attributes.Fps,
+			Uploader:         attributes.Uploader.Name,
+			Url:              attributes.Url,
+			Files:            []SubtitleFile{},
+		}
+		for _, file := range attributes.Files {
+			subtitle.Files = append(subtitle.Files, SubtitleFile{Id: strconv.Itoa(file.FileId), Name: file.FileName})
+		}
+		if len(subtitle.Files) > 0 {
+			result.Items = append(result.Items, subtitle)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *openSubtitles) Download(ctx context.Context, fileId string, directory string, progress bool) (DownloadData, error) {
+	if err := p.validate(); err != nil {
+		return DownloadData{}, err
+	}
+	id, err := strconv.Atoi(fileId)
+	if err != nil {
+		return DownloadData{}, lib.NewError(lib.CodeInvalidArgument, "--file-id has to be a number")
+	}
+
+	data, err := lib.JSONMarshal(DownloadRequestData{FileId: id})
+	if err != nil {
+		return DownloadData{}, err
+	}
+	resp, err := p.request(ctx, "POST", "/download", data)
+	if err != nil {
+		return DownloadData{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return DownloadData{}, openSubtitlesError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return DownloadData{}, lib.WrapCopyError(err, "failed to read download response")
+	}
+	var downloadData DownloadResponseData
+	var quotaData openSubtitlesQuotaResponse
+	if err := json.Unmarshal(body, &downloadData); err != nil {
+		return DownloadData{}, lib.WrapError(lib.CodeInvalidResponse, err, "couldn't parse download response")
+	}
+	json.Unmarshal(body, &quotaData)
+
+	// File name comes from the server, so it can't be trusted to stay inside the directory
+	fileName := sanitizeFileName(downloadData.FileName)
+	if fileName == "" {
+		fileName = defaultFileName
+	}
+	filePath := filepath.Join(directory, fileName)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadData.Link, nil)
+	if err != nil {
+		return DownloadData{}, lib.WrapError(lib.CodeInvalidResponse, err, "invalid download link")
+	}
+	response, err := p.client.Do(req)
+	if err != nil {
+		return DownloadData{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return DownloadData{}, lib.HTTPStatusError(response)
+	}
+
+	var reader io.Reader = response.Body
+	if progress {
+		progress := lib.NewProgressWriter(ctx, response.ContentLength, 0)
+		defer progress.Done()
+		reader = io.TeeReader(response.Body, progress)
+	}
+	if _, err := writeBodyToFile(reader, filePath); err != nil {
+		return DownloadData{}, err
+	}
+
+	return DownloadData{
+		File:      filePath,
+		Remaining: downloadData.Remaining,
+		Total:     downloadData.Remaining + downloadData.Requests,
+		ResetTime: downloadData.ResetTime,
+		Quota:     openSubtitlesQuota(resp.Header, quotaData),
+	}, nil
+}
+
+func (p *openSubtitles) Login(ctx context.Context, username, password string, remember bool) (SubtitleLoginResult, error) {
+	if err := p.validate(); err != nil {
+		return SubtitleLoginResult{}, err
+	}
+	session, response, err := p.login(ctx, username, password)
+	if err != nil {
+		return SubtitleLoginResult{}, err
+	}
+	if remember {
+		err = saveSubtitleCredentials(p.sessionPath, subtitleCredentials{Username: username, Password: password})
+	} else if err = os.Remove(credentialsPath(p.sessionPath)); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return SubtitleLoginResult{}, lib.WrapError(lib.CodeIO, err, "failed to update credentials")
+	}
+	return SubtitleLoginResult{
+		Provider:         "opensubtitles",
+		Username:         session.Username,
+		ExpiresAt:        session.ExpiresAt,
+		AllowedDownloads: response.User.AllowedDownloads,
+		Level:            response.User.Level,
+		Vip:              response.User.Vip,
+	}, nil
+}
+
+// Logs in, and saves the session.
+func (p *openSubtitles) login(ctx context.Context, username, password string) (subtitleSession, openSubtitlesLoginResponse, error) {
+	var response openSubtitlesLoginResponse
+	if p.sessionPath == "" {
+		return subtitleSession{}, response, lib.MissingArgument("session-file")
+	}
+
+	data, err := lib.JSONMarshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return subtitleSession{}, response, err
+	}
+	resp, err := p.send(ctx, "POST", "/login", data, nil)
+	if err != nil {
+		return subtitleSession{}, response, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return subtitleSession{}, response, openSubtitlesError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || response.Token == "" {
+		return subtitleSession{}, response, lib.NewError(lib.CodeInvalidResponse, "couldn't parse login response")
+	}
+
+	session := subtitleSession{
+		Username:  username,
+		Token:     response.Token,
+		BaseUrl:   response.BaseUrl,
+		ExpiresAt: tokenExpiration(response.Token),
+	}
+	return session, response, saveSubtitleSession(p.sessionPath, session)
+}
+
+func (p *openSubtitles) Logout(ctx context.Context) error {
+	if p.sessionPath == "" {
+		return lib.MissingArgument("session-file")
+	}
+	session, err := loadSubtitleSession(p.sessionPath)
+	if err == nil && session != nil && p.validate() == nil {
+		// Session is forgotten even when the server can't be reached, as the token expires on its own
+		if resp, err := p.send(ctx, "DELETE", "/logout", nil, session); err == nil {
+			resp.Body.Close()
+		}
+	}
+	for _, path := range []string{p.sessionPath, credentialsPath(p.sessionPath)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return lib.WrapError(lib.CodeIO, err, "failed to delete session")
+		}
+	}
+	return nil
+}
+
+// Sends a request authorized by the logged in session, if there is one. Expired sessions are renewed
+// before the request, and when the token is rejected, the request is retried once with a new one.
+// Sessions that can't be renewed are ignored, and the request is made anonymously.
+func (p *openSubtitles) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var session *subtitleSession
+	if p.sessionPath != "" {
+		var err error
+		if session, err = loadSubtitleSession(p.sessionPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if session != nil && time.Now().After(session.ExpiresAt.Add(-time.Minute)) {
+		session = p.renew(ctx, session)
+	}
+
+	resp, err := p.send(ctx, method, path, body, session)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || session == nil {
+		return resp, err
+	}
+	resp.Body.Close()
+	return p.send(ctx, method, path, body, p.renew(ctx, session))
+}
+
+// Logs in again with remembered credentials. Returns nil when the session can't be renewed.
+func (p *openSubtitles) renew(ctx context.Context, session *subtitleSession) *subtitleSession {
+	credentials, err := loadSubtitleCredentials(p.sessionPath)
+	if err != nil || credentials == nil || credentials.Username != session.Username {
+		return nil
+	}
+	renewed, _, err := p.login(ctx, credentials.Username, credentials.Password)
+	if err != nil {
+		return nil
+	}
+	return &renewed
+}
+
+// Sends a request to the session's API host, authorized by its token. Session can be nil.
+func (p *openSubtitles) send(ctx context.Context, method, path string, body []byte, session *subtitleSession) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.apiBase(session)+path, reader)
+	if err != nil {
+		return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid request")
+	}
+	req.Header = http.Header{
+		"Accept":     {"application/json"},
+		"Api-Key":    {p.apiKey},
+		"User-Agent": {p.agent},
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if session != nil && session.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+	}
+	return p.client.Do(req)
+}
+
+// Error for a non-OK API response, with the explanation and quota from its body.
+func openSubtitlesError(resp *http.Response) *lib.Error {
+	err := lib.HTTPStatusError(resp)
+	var body openSubtitlesQuotaResponse
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &body)
+
+	quota := openSubtitlesQuota(resp.Header, body)
+	if quota != nil && quota.Message != "" {
+		err.Message += ": " + quota.Message
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		err.Code = lib.CodeUnauthorized
+	}
+	// Exhausted download quota is reported as 406
+	limited := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusNotAcceptable
+	if limited {
+		err.Code = lib.CodeRateLimited
+		err.Retryable = true
+	}
+	if limited || (quota != nil && (quota.Remaining != nil || quota.ResetAt != nil)) {
+		err.WithDetails(subtitleErrorDetails{Quota: quota})
+	}
+	return err
+}
+
+// Reads quota from rate limit headers, or from download quota fields of the response body when it has them.
+// Returns nil when the response says nothing about it.
+func openSubtitlesQuota(header http.Header, body openSubtitlesQuotaResponse) *SubtitleQuota {
+	now := time.Now()
+	quota := SubtitleQuota{
+		Limit:     headerInt(header, "X-RateLimit-Limit", "RateLimit-Limit", "X-RateLimit-Limit-Second"),
+		Remaining: headerInt(header, "X-RateLimit-Remaining", "RateLimit-Remaining", "X-RateLimit-Remaining-Second"),
+	}
+	if reset := headerInt(header, "X-RateLimit-Reset", "RateLimit-Reset"); reset != nil {
+		// Either seconds until reset, or a unix timestamp
+		resetAt := now.Add(time.Duration(*reset) * time.Second)
+		if *reset > 1e9 {
+			resetAt = time.Unix(int64(*reset), 0)
+		}
+		quota.ResetAt = &resetAt
+	}
+	if retryAfter, ok := lib.ParseRetryAfter(header); ok {
+		resetAt := now.Add(retryAfter)
+		quota.ResetAt = &resetAt
+	}
+
+	if body.Remaining != nil {
+		// Remaining is negative when the quota was exceeded
+		remaining := max(*body.Remaining, 0)
+		quota.Remaining = &remaining
+		quota.Limit = nil
+		if body.Requests != nil {
+			limit := *body.Requests + *body.Remaining
+			quota.Limit = &limit
+		}
+	}
+	if resetAt, err := time.Parse(time.RFC3339, body.ResetTimeUTC); err == nil {
+		quota.ResetAt = &resetAt
+	}
+	quota.Message = strings.TrimSpace(body.Message)
+	if quota.Message == "" && len(body.Errors) > 0 {
+		quota.Message = strings.Join(body.Errors, " ")
+	}
+
+	if quota.Limit == nil && quota.Remaining == nil && quota.ResetAt == nil && quota.Message == "" {
+		return nil
+	}
+	if quota.ResetAt != nil {
+		resetAt := quota.ResetAt.UTC()
+		resetIn := max(int(math.Ceil(resetAt.Sub(now).Seconds())), 0)
+		quota.ResetAt, quota.ResetIn = &resetAt, &resetIn
+	}
+	return &quota
+}
+
+// First of the headers that has an integer value.
+func headerInt(header http.Header, names ...string) *int {
+	for _, name := range names {
+		if value, err := strconv.Atoi(strings.TrimSpace(header.Get(name))); err == nil {
+			return &value
+		}
+	}
+	return nil
+}
+
+// Reads expiration from JWT's `exp` claim, or assumes the usual token lifetime.
+func tokenExpiration(token string) time.Time {
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil &&
+			json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0).UTC()
+		}
+	}
+	return time.Now().Add(openSubtitlesTokenLifetime).UTC()
+}
+
+// Escape and lowercase (open subtitles requirement) a URL parameter
+func escapeParam(str string) string {
+	return url.QueryEscape(strings.ToLower(str))
+}
@@ -0,0 +1,388 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+// Status of a download queue item.
+const (
+	queueQueued      = "queued"
+	queueDownloading = "downloading"
+	queuePaused      = "paused"
+	queueDone        = "done"
+	queueFailed      = "failed"
+	queueCanceled    = "canceled"
+)
+
+const (
+	queueStateFile = "download-queue.json"
+	queueLockFile  = "download-queue.lock"
+	// How often `run` saves progress and checks whether the item was paused or canceled.
+	queuePollInterval = 500 * time.Millisecond
+	// Items downloading without an update for this long were left behind by a crashed `run`.
+	queueStaleAge = 30 * time.Second
+)
+
+var queueSubcommands = []string{"add", "list", "pause", "resume", "cancel", "run"}
+
+type QueueItem struct {
+	Id string `json:"id"`
+	DownloadRequest
+	Status    string          `json:"status"`
+	Bytes     int64           `json:"bytes"`
+	Total     *int64          `json:"total,omitempty"` // Omitted until known.
+	Error     *lib.ErrorData  `json:"error,omitempty"`
+	Result    *DownloadResult `json:"result,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Result of all subcommands. Those operating on a single item return just that item.
+type QueueResult struct {
+	Items []QueueItem `json:"items"`
+}
+
+// Event emitted by `download-queue run`. Type is `status` when item's status changes, or `progress`.
+type QueueEvent struct {
+	Type   string  `json:"type"`
+	Id     string  `json:"id"`
+	Status string  `json:"status,omitempty"`
+	Bytes  int64   `json:"bytes"`
+	Total  *int64  `json:"total,omitempty"`
+	Speed  float64 `json:"speed,omitempty"`
+}
+
+type downloadQueueFlags struct {
+	downloadFlags
+	dir *string
+}
+
+func newDownloadQueueFlags() (*flag.FlagSet, downloadQueueFlags) {
+	cmd := flag.NewFlagSet("download-queue", flag.ContinueOnError)
+	flags := downloadQueueFlags{
+		downloadFlags: defineDownloadFlags(cmd),
+		dir:           cmd.String("dir", lib.ConfigDir(), "Directory where queue state is stored."),
+	}
+	// Only used by `run`, as items are downloaded with the client of the process running the queue
+	flags.client = lib.DefineClientFlags(cmd)
+	return cmd, flags
+}
+
+func DownloadQueue(ctx context.Context, args []string) any {
+	cmd, flags := newDownloadQueueFlags()
+	positional := lib.Must(lib.ParseFlagsInterspersed(cmd, args))
+
+	if len(positional) == 0 {
+		lib.Check(lib.NewError(lib.CodeMissingArgument, "subcommand required: %s", strings.Join(queueSubcommands, ", ")))
+	}
+	if len(*flags.dir) == 0 {
+		lib.Check(lib.MissingArgument("dir"))
+	}
+
+	subcommand, rest := positional[0], positional[1:]
+	if subcommand == "run" {
+		lib.StartStream(ctx)
+	} else if passed := flags.client.Passed(); len(passed) > 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--%s only applies to run", passed[0]))
+	}
+	queue := downloadQueue{dir: *flags.dir}
+
+	// Subcommands operating on a single item
+	itemId := ""
+	if slices.Contains([]string{"pause", "resume", "cancel"}, subcommand) {
+		if len(rest) != 1 {
+			lib.Check(lib.NewError(lib.CodeMissingArgument, "%s requires exactly one item id", subcommand))
+		}
+		itemId = rest[0]
+	} else if len(rest) > 0 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "unexpected arguments: %v", rest))
+	}
+
+	switch subcommand {
+	case "add":
+		request := parseDownloadRequest(flags.downloadFlags)
+		now := time.Now().UTC()
+		item := QueueItem{
+			Id:              newQueueId(),
+			DownloadRequest: request,
+			Status:          queueQueued,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		lib.Check(queue.update(ctx, func(items []QueueItem) []QueueItem {
+			return append(items, item)
+		}))
+		return QueueResult{Items: []QueueItem{item}}
+
+	case "list":
+		return QueueResult{Items: lib.Must(queue.load())}
+
+	case "pause":
+		item := lib.Must(queue.transition(ctx, itemId, queuePaused, queueQueued, queueDownloading))
+		return QueueResult{Items: []QueueItem{item}}
+
+	case "resume":
+		item := lib.Must(queue.transition(ctx, itemId, queueQueued, queuePaused, queueFailed, queueCanceled))
+		return QueueResult{Items: []QueueItem{item}}
+
+	case "cancel":
+		item := lib.Must(queue.transition(ctx, itemId, queueCanceled, queueQueued, queueDownloading, queuePaused, queueFailed))
+		// Downloading item's files are cleaned up by the `run` process once it notices
+		if item.Status == queueCanceled {
+			for _, partPath := range item.partPaths() {
+				os.Remove(partPath)
+			}
+		}
+		return QueueResult{Items: []QueueItem{item}}
+
+	case "run":
+		queue.client = lib.Must(flags.client.Client())
+		lib.Check(queue.run(ctx))
+		return QueueResult{Items: lib.Must(queue.load())}
+
+	default:
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "unknown subcommand %s, expected one of: %s", subcommand, strings.Join(queueSubcommands, ", ")))
+		return nil
+	}
+}
+
+func newQueueId() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(buf)
+}
+
+// Download queue persisted in a JSON state file, safe to be modified by multiple processes at once.
+type downloadQueue struct {
+	dir    string
+	client *lib.HTTPClient
+}
+
+func (q downloadQueue) statePath() string {
+	return filepath.Join(q.dir, queueStateFile)
+}
+
+func (q downloadQueue) load() ([]QueueItem, error) {
+	items := []QueueItem{}
+	data, err := os.ReadFile(q.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return items, nil
+	} else if err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "failed to read download queue")
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "download queue state is corrupted")
+	}
+	return items, nil
+}
+
+// Loads items, lets `modify` change them, and saves the result, all while holding the queue lock.
+func (q downloadQueue) update(ctx context.Context, modify func(items []QueueItem) []QueueItem) error {
+	unlock, err := lib.LockFile(ctx, filepath.Join(q.dir, queueLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	items, err := q.load()
+	if err != nil {
+		return err
+	}
+	data, err := lib.JSONMarshal(modify(items))
+	if err != nil {
+		return err
+	}
+	return lib.WriteFileAtomic(q.statePath(), data, 0644)
+}
+
+// Changes status of an item, if its current status is one of `from`.
+func (q downloadQueue) transition(ctx context.Context, id string, to string, from ...string) (QueueItem, error) {
+	var result QueueItem
+	var resultErr error
+	err := q.update(ctx, func(items []QueueItem) []QueueItem {
+		index := slices.IndexFunc(items, func(item QueueItem) bool { return item.Id == id })
+		if index < 0 {
+			resultErr = lib.NewError(lib.CodeInvalidArgument, "download queue has no item %s", id)
+			return items
+		}
+		item := &items[index]
+		if !slices.Contains(from, item.Status) {
+			resultErr = lib.NewError(lib.CodeInvalidArgument, "can't change status of %s item to %s", item.Status, to)
+			return items
+		}
+		item.Status = to
+		item.UpdatedAt = time.Now().UTC()
+		if to == queueQueued {
+			item.Error = nil
+		}
+		result = *item
+		return items
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, resultErr
+}
+
+// Downloads queued items one by one until there are none left.
+func (q downloadQueue) run(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Claim the next queued item, and recover items abandoned by a crashed run
+		var item *QueueItem
+		err := q.update(ctx, func(items []QueueItem) []QueueItem {
+			now := time.Now().UTC()
+			for i := range items {
+				if items[i].Status == queueDownloading && now.Sub(items[i].UpdatedAt) > queueStaleAge {
+					items[i].Status = queueQueued
+				}
+			}
+			for i := range items {
+				if items[i].Status == queueQueued {
+					items[i].Status = queueDownloading
+					items[i].UpdatedAt = now
+					claimed := items[i]
+					item = &claimed
+					break
+				}
+			}
+			return items
+		})
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return nil
+		}
+
+		lib.Emit(ctx, QueueEvent{Type: "status", Id: item.Id, Status: item.Status, Bytes: item.Bytes, Total: item.Total})
+		q.runItem(ctx, item)
+		lib.Emit(ctx, QueueEvent{Type: "status", Id: item.Id, Status: item.Status, Bytes: item.Bytes, Total: item.Total})
+	}
+}
+
+// Downloads a claimed item, and saves its final state.
+func (q downloadQueue) runItem(ctx context.Context, item *QueueItem) {
+	itemCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Track progress, and pass it on as item events
+	progress := make(chan lib.ProgressEvent, 1)
+	itemCtx = lib.WithEmitter(itemCtx, func(event any) {
+		if event, ok := event.(lib.ProgressEvent); ok {
+			lib.Emit(ctx, QueueEvent{Type: "progress", Id: item.Id, Bytes: event.Bytes, Total: event.Total, Speed: event.Speed})
+			select {
+			case <-progress:
+			default:
+			}
+			progress <- event
+		}
+	})
+
+	// Save progress periodically, and watch for the item being paused or canceled by another process
+	done := make(chan struct{})
+	watcherDone := make(chan struct{})
+	externalStatus := ""
+	go func() {
+		defer close(watcherDone)
+		ticker := time.NewTicker(queuePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			var latest lib.ProgressEvent
+			hasProgress := false
+			select {
+			case latest = <-progress:
+				hasProgress = true
+			default:
+			}
+
+			q.update(ctx, func(items []QueueItem) []QueueItem {
+				index := slices.IndexFunc(items, func(other QueueItem) bool { return other.Id == item.Id })
+				if index < 0 {
+					externalStatus = queueCanceled
+					cancel()
+					return items
+				}
+				stored := &items[index]
+				if stored.Status != queueDownloading {
+					externalStatus = stored.Status
+					cancel()
+					return items
+				}
+				stored.UpdatedAt = time.Now().UTC()
+				if hasProgress {
+					stored.Bytes = latest.Bytes
+					stored.Total = latest.Total
+				}
+				return items
+			})
+		}
+	}()
+
+	result, err := item.download(itemCtx, q.client, true)
+	close(done)
+	<-watcherDone
+
+	// Drain the last progress update
+	select {
+	case latest := <-progress:
+		item.Bytes = latest.Bytes
+		item.Total = latest.Total
+	default:
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		// Run itself was interrupted, so the item will be picked up by the next one
+		item.Status = queueQueued
+	case externalStatus != "":
+		item.Status = externalStatus
+		if externalStatus == queueCanceled {
+			for _, partPath := range item.partPaths() {
+				os.Remove(partPath)
+			}
+		}
+	case err != nil:
+		item.Status = queueFailed
+		errorData := lib.NewErrorData(err)
+		item.Error = &errorData
+	default:
+		item.Status = queueDone
+		item.Error = nil
+		item.Result = &result
+	}
+
+	q.update(context.Background(), func(items []QueueItem) []QueueItem {
+		index := slices.IndexFunc(items, func(other QueueItem) bool { return other.Id == item.Id })
+		if index >= 0 {
+			items[index].Status = item.Status
+			items[index].Bytes = item.Bytes
+			items[index].Total = item.Total
+			items[index].Error = item.Error
+			items[index].Result = item.Result
+			items[index].UpdatedAt = time.Now().UTC()
+		}
+		return items
+	})
+}
@@ -0,0 +1,179 @@
+package commands
+
+import (
+	"context"
+	"flag"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+type Command struct {
+	Name        string
+	Description string
+	// Positional arguments, e.g.: `<url>`. Empty when command accepts none.
+	Arguments string
+	// Creates command's flag set. Used to describe flags in help and capabilities.
+	Flags func() *flag.FlagSet
+	// Zero value of the command's result, used to describe its schema. Nil when result is opaque.
+	Result any
+	Run    func(ctx context.Context, args []string) any
+}
+
+// Human readable text output. Printed as is instead of being JSON encoded.
+type Text string
+
+// Populated in `init` because commands like `help` need to reference the registry itself.
+var registry []Command
+
+func init() {
+	registry = []Command{
+		{
+			Name:        "search-subtitles",
+			Description: "Search subtitles with a provider, Open Subtitles by default.",
+			Flags:       flagSetOnly(newSearchSubtitlesFlags),
+			Result:      SubtitleSearchResult{},
+			Run:         SearchSubtitles,
+		},
+		{
+			Name:        "download-subtitles",
+			Description: "Download subtitles from a provider into a directory.",
+			Flags:       flagSetOnly(newDownloadSubtitlesFlags),
+			Result:      DownloadData{},
+			Run:         DownloadSubtitles,
+		},
+		{
+			Name:        "subtitles-login",
+			Description: "Log into a subtitle provider account. Following subtitle commands use the session.",
+			Flags:       flagSetOnly(newSubtitlesLoginFlags),
+			Result:      SubtitleLoginResult{},
+			Run:         SubtitlesLogin,
+		},
+		{
+			Name:        "subtitles-logout",
+			Description: "Log out of a subtitle provider account, and forget the session.",
+			Flags:       flagSetOnly(newSubtitlesLogoutFlags),
+			Result:      SubtitlesLogoutResult{},
+			Run:         SubtitlesLogout,
+		},
+		{
+			Name:        "subtitle-providers",
+			Description: "List subtitle providers and what they support.",
+			Flags:       newSubtitleProvidersFlags,
+			Result:      SubtitleProvidersResult{},
+			Run:         SubtitleProviders,
+		},
+		{
+			Name:        "get-clipboard",
+			Description: "Read text from clipboard.",
+			Flags:       newGetClipboardFlags,
+			Result:      ClipboardResult{},
+			Run:         GetClipboard,
+		},
+		{
+			Name:        "set-clipboard",
+			Description: "Write text to clipboard.",
+			Arguments:   "<text>",
+			Flags:       newSetClipboardFlags,
+			Result:      ClipboardResult{},
+			Run:         SetClipboard,
+		},
+		{
+			Name:        "download",
+			Description: "Download a file from URL.",
+			Flags:       flagSetOnly(newDownloadFlags),
+			Result:      DownloadResult{},
+			Run:         Download,
+		},
+		{
+			Name:        "download-queue",
+			Description: "Manage a persistent queue of downloads. Subcommand `add` accepts the same flags as `download`, except HTTP client flags, which are passed to `run`.",
+			Arguments:   "add|list|pause|resume|cancel|run [id]",
+			Flags:       flagSetOnly(newDownloadQueueFlags),
+			Result:      QueueResult{},
+			Run:         DownloadQueue,
+		},
+		{
+			Name:        "http",
+			Description: "Make an HTTP request with any method, including HEAD and OPTIONS.",
+			Arguments:   "<url>",
+			Flags:       func() *flag.FlagSet { cmd, _ := newHttpFlags(""); return cmd },
+			Result:      HTTPResult{},
+			Run: func(ctx context.Context, args []string) any {
+				return Http(ctx, "", args)
+			},
+		},
+		httpCommand("GET"),
+		httpCommand("POST"),
+		httpCommand("PUT"),
+		httpCommand("PATCH"),
+		httpCommand("DELETE"),
+		{
+			Name:        "open",
+			Description: "Open a path or URL in the default application.",
+			Arguments:   "<path|url>",
+			Flags:       newOpenFlags,
+			Result:      OpenResult{},
+			Run:         Open,
+		},
+		{
+			Name:        "serve",
+			Description: "Read newline delimited JSON requests from stdin, and write tagged responses to stdout.",
+			Flags:       newServeFlags,
+			Run:         Serve,
+		},
+		{
+			Name:        "help",
+			Description: "Show available commands, or flags of a command.",
+			Arguments:   "[command]",
+			Flags:       newHelpFlags,
+			Run:         Help,
+		},
+		{
+			Name:        "capabilities",
+			Description: "Describe version, build, commands, their flags and result schemas as JSON.",
+			Flags:       newCapabilitiesFlags,
+			Result:      CapabilitiesResult{},
+			Run:         Capabilities,
+		},
+	}
+}
+
+func httpCommand(method string) Command {
+	cmd, _ := newHttpFlags(method)
+	return Command{
+		Name:        cmd.Name(),
+		Description: "Make an HTTP " + method + " request.",
+		Arguments:   "<url>",
+		Flags:       func() *flag.FlagSet { cmd, _ := newHttpFlags(method); return cmd },
+		Result:      HTTPResult{},
+		Run: func(ctx context.Context, args []string) any {
+			return Http(ctx, method, args)
+		},
+	}
+}
+
+func flagSetOnly[T any](newFlags func() (*flag.FlagSet, T)) func() *flag.FlagSet {
+	return func() *flag.FlagSet {
+		cmd, _ := newFlags()
+		return cmd
+	}
+}
+
+// Runs a command and returns its result.
+func Dispatch(ctx context.Context, name string, args []string) any {
+	command, ok := Find(name)
+	if !ok {
+		lib.Check(lib.NewError(lib.CodeUnknownCommand, "unknown command: %s", name))
+	}
+	return command.Run(ctx, args)
+}
+
+// Finds a command by its name.
+func Find(name string) (Command, bool) {
+	for _, command := range registry {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
@@ -0,0 +1,305 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+const (
+	maxConnections      = 16
+	minSegmentSize      = 1 << 20 // 1 MiB
+	segmentAttempts     = 3
+	segmentRetryBackoff = 500 * time.Millisecond
+	// How often segment progress is saved while downloading.
+	segmentStateInterval = time.Second
+)
+
+// Returned when server doesn't support ranges, or the file is too small to be worth splitting.
+var errSegmentsUnsupported = errors.New("segmented download not supported")
+
+// Byte range of a segmented download.
+type downloadSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`  // Inclusive.
+	Done  int64 `json:"done"` // Bytes already written, starting at Start.
+}
+
+func (s *downloadSegment) remaining() int64 {
+	return s.End - s.Start + 1 - s.Done
+}
+
+// Whether the partial download state in metaPath belongs to a segmented download of url.
+func hasSegmentState(metaPath, url string) bool {
+	var partial partialDownload
+	data, err := os.ReadFile(metaPath)
+	return err == nil && json.Unmarshal(data, &partial) == nil && partial.Url == url && len(partial.Segments) > 0
+}
+
+// Downloads URL into partPath over multiple connections, each fetching a range of the file.
+// Failed segments are retried independently. Their progress is periodically saved into metaPath,
+// so that the download can be resumed even when the process is killed. Returns `errSegmentsUnsupported` when server doesn't
+// support ranges, in which case nothing was written and caller should fall back to a single stream.
+func downloadSegmented(
+	ctx context.Context,
+	url, partPath, metaPath string,
+	resolvePath func(resp *http.Response) error,
+	options downloadOptions,
+) (downloadInfo, error) {
+	info := downloadInfo{}
+
+	// Probe the server
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return info, lib.WrapError(lib.CodeInvalidArgument, err, "failed to create request")
+	}
+	resp, err := options.client.Do(req)
+	if err != nil {
+		return info, errSegmentsUnsupported
+	}
+	resp.Body.Close()
+	size := resp.ContentLength
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || size < 2*minSegmentSize {
+		return info, errSegmentsUnsupported
+	}
+
+	state := partialDownload{
+		Url:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         size,
+	}
+	info.filename = fileNameFromResponse(resp)
+	info.finalUrl = resp.Request.URL.String()
+
+	// Resume previous state if the file didn't change since
+	var previous partialDownload
+	if data, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(data, &previous) == nil &&
+		previous.Url == url && previous.Size == size && previous.ifRange() != "" && previous.ifRange() == state.ifRange() {
+		if stat, err := os.Stat(partPath); err == nil && stat.Size() == size {
+			state.Segments = previous.Segments
+			info.resumed = true
+		}
+	}
+
+	if len(state.Segments) == 0 {
+		count := min(int64(max(options.connections, 1)), int64(maxConnections), size/minSegmentSize)
+		if count < 2 {
+			return info, errSegmentsUnsupported
+		}
+		segmentSize := size / count
+		for i := int64(0); i < count; i++ {
+			end := (i+1)*segmentSize - 1
+			if i == count-1 {
+				end = size - 1
+			}
+			state.Segments = append(state.Segments, downloadSegment{Start: i * segmentSize, End: end})
+		}
+	}
+
+	if err := resolvePath(resp); err != nil {
+		return info, err
+	}
+
+	// Preallocate the file
+	flags := os.O_WRONLY | os.O_CREATE
+	if !info.resumed {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return info, lib.WrapError(lib.CodeIO, err, "failed to create file")
+	}
+	defer out.Close()
+	if err := out.Truncate(size); err != nil {
+		return info, lib.WrapError(lib.CodeIO, err, "failed to allocate file")
+	}
+
+	var progress io.Writer = io.Discard
+	if options.progress {
+		var done int64
+		for _, segment := range state.Segments {
+			done += segment.Done
+		}
+		progressWriter := lib.NewProgressWriter(ctx, size, done)
+		defer progressWriter.Done()
+		progress = progressWriter
+	}
+
+	// Save progress right away and then periodically, unless there's no way to tell the file didn't change
+	var stateMutex sync.Mutex
+	saveState := func() {
+		stateMutex.Lock()
+		data, err := lib.JSONMarshal(state)
+		stateMutex.Unlock()
+		if err == nil {
+			lib.WriteFileAtomic(metaPath, data, 0644)
+		}
+	}
+	saverDone := make(chan struct{})
+	saverStopped := make(chan struct{})
+	if state.ifRange() != "" {
+		saveState()
+		go func() {
+			defer close(saverStopped)
+			ticker := time.NewTicker(segmentStateInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-saverDone:
+					return
+				case <-ticker.C:
+					saveState()
+				}
+			}
+		}()
+	} else {
+		close(saverStopped)
+	}
+
+	// Download segments concurrently, and abort the rest when one of them fails for good
+	segmentsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+
+	for i := range state.Segments {
+		segment := &state.Segments[i]
+		if segment.remaining() <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := downloadSegmentWithRetries(segmentsCtx, options.client, info.finalUrl, state.ifRange(), out, segment, &stateMutex, progress)
+			if err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				errMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(saverDone)
+	<-saverStopped
+
+	if firstErr != nil {
+		// Save final progress so the download can be resumed, unless the file changed under us
+		if errors.Is(firstErr, errSegmentsUnsupported) || state.ifRange() == "" {
+			out.Close()
+			os.Remove(partPath)
+			os.Remove(metaPath)
+		} else {
+			saveState()
+		}
+		return info, firstErr
+	}
+
+	if err := out.Close(); err != nil {
+		return info, lib.WrapError(lib.CodeIO, err, "failed to write file")
+	}
+
+	return info, nil
+}
+
+// Downloads remaining bytes of a segment, retrying on network errors and server failures.
+func downloadSegmentWithRetries(
+	ctx context.Context,
+	client *lib.HTTPClient,
+	url, ifRange string,
+	out *os.File,
+	segment *downloadSegment,
+	stateMutex *sync.Mutex,
+	progress io.Writer,
+) error {
+	var err error
+	for attempt := 1; attempt <= segmentAttempts; attempt++ {
+		err = downloadSegmentOnce(ctx, client, url, ifRange, out, segment, stateMutex, progress)
+		var e *lib.Error
+		if err == nil || ctx.Err() != nil || errors.Is(err, errSegmentsUnsupported) || !errors.As(err, &e) || !e.Retryable {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(segmentRetryBackoff * time.Duration(attempt)):
+		}
+	}
+	return err
+}
+
+func downloadSegmentOnce(
+	ctx context.Context,
+	client *lib.HTTPClient,
+	url, ifRange string,
+	out *os.File,
+	segment *downloadSegment,
+	stateMutex *sync.Mutex,
+	progress io.Writer,
+) error {
+	start := segment.Start + segment.Done
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return lib.WrapError(lib.CodeInvalidArgument, err, "failed to create request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, segment.End))
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 200 means the server ignored the range, or the file changed since the download started
+	if resp.StatusCode == http.StatusOK {
+		return errSegmentsUnsupported
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return lib.HTTPStatusError(resp)
+	}
+	if rangeStart, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || rangeStart != start {
+		return lib.NewError(lib.CodeInvalidResponse, "unexpected Content-Range: %s", resp.Header.Get("Content-Range"))
+	}
+
+	writer := &segmentWriter{out: io.NewOffsetWriter(out, start), segment: segment, mutex: stateMutex}
+	_, err = io.Copy(io.MultiWriter(writer, progress), io.LimitReader(resp.Body, segment.remaining()))
+	if err != nil {
+		return lib.WrapCopyError(err, "failed to write segment")
+	}
+	if segment.remaining() > 0 {
+		return lib.NewError(lib.CodeNetwork, "segment ended prematurely")
+	}
+
+	return nil
+}
+
+// Writes into the file at segment's offset, and keeps track of how much of it is done.
+// Progress is only updated after the data is written, so saved state never claims more than the file has.
+type segmentWriter struct {
+	out     io.Writer
+	segment *downloadSegment
+	mutex   *sync.Mutex // Guards segment progress, which is saved from another goroutine.
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	n, err := w.out.Write(b)
+	w.mutex.Lock()
+	w.segment.Done += int64(n)
+	w.mutex.Unlock()
+	return n, err
+}
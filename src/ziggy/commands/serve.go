@@ -0,0 +1,275 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"uosc/bins/src/ziggy/lib"
+)
+
+// Request read from stdin in serve mode, one per line.
+type ServeRequest struct {
+	Id      json.RawMessage `json:"id"`
+	Command string          `json:"command"`
+	// Either an array of raw command line arguments, or an object of flags.
+	// Positional arguments can be passed in the object under the `_` key.
+	Args json.RawMessage `json:"args"`
+}
+
+// Response written to stdout in serve mode, one per line.
+type ServeResponse struct {
+	Id     json.RawMessage `json:"id"`
+	Event  any             `json:"event,omitempty"` // Set on intermediate events of streaming commands.
+	Result any             `json:"result,omitempty"`
+	Error  *lib.ErrorData  `json:"error,omitempty"`
+}
+
+type CancelArgs struct {
+	Id json.RawMessage `json:"id"`
+}
+
+func newServeFlags() *flag.FlagSet {
+	return flag.NewFlagSet("serve", flag.ContinueOnError)
+}
+
+func Serve(_ context.Context, args []string) any {
+	lib.Check(lib.ParseFlags(newServeFlags(), args))
+	lib.Check(serve(os.Stdin, os.Stdout))
+	return nil
+}
+
+// Reads newline delimited JSON requests from `in` and writes tagged responses to `out`.
+// Requests are executed concurrently, so responses can arrive in a different order.
+// Streaming commands send any number of `{"id":<id>,"event":{...}}` lines before their response.
+// Special `cancel` command aborts a running request: `{"command":"cancel","args":{"id":<id>}}`.
+// Returns when `in` is exhausted and all running requests are finished.
+func serve(in io.Reader, out io.Writer) error {
+	reader := bufio.NewReader(in)
+	var outMutex sync.Mutex
+	var wg sync.WaitGroup
+	var runningMutex sync.Mutex
+	running := map[string]context.CancelFunc{}
+
+	respond := func(response ServeResponse) {
+		if len(response.Id) == 0 {
+			response.Id = json.RawMessage("null")
+		}
+		data, err := lib.JSONMarshal(response)
+		if err != nil {
+			data, _ = lib.JSONMarshal(ServeResponse{Id: response.Id, Error: errorData(lib.WrapError(lib.CodeInternal, err, "failed to serialize response"))})
+		}
+		outMutex.Lock()
+		defer outMutex.Unlock()
+		out.Write(data)
+	}
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+
+		if len(line) > 0 {
+			var request ServeRequest
+			if err := json.Unmarshal(line, &request); err != nil {
+				respond(ServeResponse{Error: errorData(lib.WrapError(lib.CodeInvalidArgument, err, "invalid request"))})
+			} else if request.Command == "cancel" {
+				var cancelArgs CancelArgs
+				if err := json.Unmarshal(request.Args, &cancelArgs); err != nil || len(cancelArgs.Id) == 0 {
+					respond(ServeResponse{Id: request.Id, Error: errorData(lib.MissingArgument("id"))})
+				} else {
+					runningMutex.Lock()
+					cancel, ok := running[string(cancelArgs.Id)]
+					runningMutex.Unlock()
+					if ok {
+						cancel()
+					}
+					respond(ServeResponse{Id: request.Id, Result: map[string]bool{"canceled": ok}})
+				}
+			} else {
+				args, err := requestArgs(request.Args)
+				if err != nil {
+					respond(ServeResponse{Id: request.Id, Error: errorData(err)})
+				} else {
+					ctx, cancel := context.WithCancel(lib.WithoutStdin(context.Background()))
+					// Requests without an id can't be canceled, so they aren't tracked
+					key := string(request.Id)
+					tracked := len(key) > 0 && key != "null"
+					runningMutex.Lock()
+					_, duplicate := running[key]
+					if tracked && !duplicate {
+						running[key] = cancel
+					}
+					runningMutex.Unlock()
+
+					if tracked && duplicate {
+						cancel()
+						respond(ServeResponse{Id: request.Id, Error: errorData(lib.NewError(lib.CodeInvalidArgument, "request with id %s is already running", key))})
+					} else {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							defer func() {
+								if tracked {
+									runningMutex.Lock()
+									delete(running, key)
+									runningMutex.Unlock()
+								}
+								cancel()
+							}()
+							id := request.Id
+							ctx = lib.WithEmitter(ctx, func(event any) {
+								respond(ServeResponse{Id: id, Event: event})
+							})
+							respond(serveRequest(ctx, id, request.Command, args))
+						}()
+					}
+				}
+			}
+		}
+
+		if readErr != nil {
+			wg.Wait()
+			if errors.Is(readErr, io.EOF) {
+				return nil
+			}
+			return readErr
+		}
+	}
+}
+
+// Executes a single request, converting any failure into an error response.
+func serveRequest(ctx context.Context, id json.RawMessage, command string, args []string) (response ServeResponse) {
+	response.Id = id
+
+	// A bug in one command shouldn't take down the whole server
+	defer func() {
+		if r := recover(); r != nil {
+			response = ServeResponse{Id: id, Error: errorData(lib.NewError(lib.CodeInternal, "%v", r))}
+		}
+	}()
+
+	result := lib.Run(func() any {
+		if command == "serve" {
+			lib.Check(lib.NewError(lib.CodeInvalidArgument, "serve can't be called from within serve mode"))
+		}
+		return Dispatch(ctx, command, args)
+	})
+	if data, ok := result.(lib.ErrorData); ok {
+		response.Error = &data
+	} else {
+		response.Result = result
+	}
+	return response
+}
+
+func errorData(err error) *lib.ErrorData {
+	data := lib.NewErrorData(err)
+	return &data
+}
+
+// Converts request arguments into command line arguments.
+func requestArgs(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return []string{}, nil
+	}
+
+	// Raw command line arguments
+	if raw[0] == '[' {
+		var args []string
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid args")
+		}
+		return args, nil
+	}
+
+	var flags map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &flags); err != nil {
+		return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid args")
+	}
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		if name != "_" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	args := []string{}
+	for _, name := range names {
+		values, err := argValues(flags[name])
+		if err != nil {
+			return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid value of %s", name)
+		}
+		for _, value := range values {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+
+	if positional, ok := flags["_"]; ok {
+		values, err := argValues(positional)
+		if err != nil {
+			return nil, lib.WrapError(lib.CodeInvalidArgument, err, "invalid positional arguments")
+		}
+		args = append(args, "--")
+		args = append(args, values...)
+	}
+
+	return args, nil
+}
+
+// Converts a JSON value into flag values. Arrays produce one value per item,
+// objects are passed as JSON strings, and `null` produces no values.
+func argValues(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	switch raw[0] {
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		values := []string{}
+		for _, item := range items {
+			value, err := argValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	default:
+		value, err := argValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+}
+
+// Converts a single JSON value into a flag value.
+func argValue(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	}
+	// Numbers, booleans, and objects are passed in their JSON form
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
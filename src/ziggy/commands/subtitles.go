@@ -1,37 +1,239 @@
 package commands
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
-	"fmt"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"uosc/bins/src/ziggy/lib"
 )
 
-const OPEN_SUBTITLES_API_URL = "https://api.opensubtitles.com/api/v1"
+// Source of subtitles used by `search-subtitles` and `download-subtitles`.
+type SubtitleProvider interface {
+	Capabilities() SubtitleCapabilities
+	Search(ctx context.Context, query SubtitleQuery) (SubtitleSearchResult, error)
+	// Downloads a subtitle file into a directory, emitting progress events when `progress` is enabled.
+	Download(ctx context.Context, fileId string, directory string, progress bool) (DownloadData, error)
+}
+
+// Implemented by providers with user accounts. Session is kept in a file, and used by all requests.
+type SubtitleAccountProvider interface {
+	// Remembered credentials are used to renew the session when it expires or is rejected.
+	Login(ctx context.Context, username, password string, remember bool) (SubtitleLoginResult, error)
+	// Ends the session, and deletes the session and credentials files.
+	Logout(ctx context.Context) error
+}
+
+// What a provider supports, so that callers can adjust their UI.
+type SubtitleCapabilities struct {
+	Hash       bool `json:"hash"`       // Search by video file hash.
+	Query      bool `json:"query"`      // Search by text query.
+	Languages  bool `json:"languages"`  // Filter results by languages.
+	Pagination bool `json:"pagination"` // Results are paginated with `--page`.
+	ApiKey     bool `json:"api_key"`    // Requires `--api-key`.
+	Login      bool `json:"login"`      // Supports `subtitles-login`.
+}
+
+// Options shared by all providers. Providers validate the ones they need.
+type subtitleProviderOptions struct {
+	client      *lib.HTTPClient
+	apiKey      string
+	agent       string
+	sessionPath string
+	// Overrides provider's API URL. Empty for the default one.
+	apiUrl string
+}
+
+const defaultSubtitleProvider = "opensubtitles"
+
+// Providers by their `--provider` name.
+var subtitleProviders = map[string]func(options subtitleProviderOptions) SubtitleProvider{
+	"opensubtitles": newOpenSubtitles,
+}
+
+func subtitleProviderNames() []string {
+	names := []string{}
+	for name := range subtitleProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func newSubtitleProvider(name string, options subtitleProviderOptions) (SubtitleProvider, error) {
+	create, ok := subtitleProviders[name]
+	if !ok {
+		return nil, lib.NewError(lib.CodeInvalidArgument, "unknown provider %s, expected one of: %s", name, strings.Join(subtitleProviderNames(), ", "))
+	}
+	return create(options), nil
+}
+
+type SubtitleQuery struct {
+	Languages []string
+	FilePath  string // Video file to hash. Hashing failures are ignored when there's a text query.
+	Query     string
+	Page      int // Starting at 1.
+}
+
+// Search results in a schema shared by all providers.
+// Fields a provider doesn't know are left at their zero values.
+type SubtitleSearchResult struct {
+	Provider   string     `json:"provider"`
+	Page       int        `json:"page"` // Starting at 1.
+	TotalPages int        `json:"total_pages"`
+	TotalCount int        `json:"total_count"` // Number of results across all pages.
+	PerPage    int        `json:"per_page"`
+	Items      []Subtitle `json:"items"`
+	// Request quota after the search, when the provider reported it.
+	Quota *SubtitleQuota `json:"quota,omitempty"`
+}
+
+type Subtitle struct {
+	Id               string  `json:"id"`
+	Release          string  `json:"release"`
+	Language         string  `json:"language"`
+	HearingImpaired  bool    `json:"hearing_impaired"`
+	ForeignPartsOnly bool    `json:"foreign_parts_only"`
+	HashMatch        bool    `json:"hash_match"` // Subtitle was made for the exact video file passed in `--hash`.
+	Downloads        int     `json:"downloads"`
+	Rating           float64 `json:"rating"` // From 0 to 10.
+	Fps              float64 `json:"fps"`
+	Uploader         string  `json:"uploader"`
+	Url              string  `json:"url,omitempty"` // Page of the subtitle on provider's website.
+	// Never empty. Pass file ID to `download-subtitles`.
+	Files []SubtitleFile `json:"files"`
+}
+
+type SubtitleFile struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Provider's request or download quota. Values the provider didn't report are omitted.
+type SubtitleQuota struct {
+	Limit     *int       `json:"limit,omitempty"`
+	Remaining *int       `json:"remaining,omitempty"`
+	ResetAt   *time.Time `json:"reset_at,omitempty"` // UTC.
+	ResetIn   *int       `json:"reset_in,omitempty"` // Seconds until reset, as of receiving the response.
+	Message   string     `json:"message,omitempty"`  // Provider's explanation.
+}
+
+// Details of errors returned by providers. Quota is reported with `rate_limited` errors.
+type subtitleErrorDetails struct {
+	Quota *SubtitleQuota `json:"quota,omitempty"`
+}
+
+// Calls `fn` again when it fails due to an exhausted quota that resets before the `budget` for waiting runs out.
+func waitForQuota[T any](ctx context.Context, budget time.Duration, fn func() (T, error)) (T, error) {
+	deadline := time.Now().Add(budget)
+	for {
+		result, err := fn()
+		var e *lib.Error
+		if err == nil || budget <= 0 || !errors.As(err, &e) || e.Code != lib.CodeRateLimited {
+			return result, err
+		}
+
+		// Poll each second when the reset time is unknown
+		wait := time.Second
+		if details, ok := e.Details.(subtitleErrorDetails); ok && details.Quota != nil && details.Quota.ResetAt != nil {
+			wait = max(time.Until(*details.Quota.ResetAt), time.Second)
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+type SubtitleLoginResult struct {
+	Provider  string    `json:"provider"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Downloads per day allowed for the account. 0 when unknown.
+	AllowedDownloads int    `json:"allowed_downloads"`
+	Level            string `json:"level,omitempty"`
+	Vip              bool   `json:"vip"`
+}
+
+// Logged in session persisted in the session file. Requests fall back to anonymous ones
+// when the session expires or is rejected, and can't be renewed.
+type subtitleSession struct {
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	BaseUrl   string    `json:"base_url,omitempty"` // API host the provider asked this user to use.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Loads a session. Returns nil when there is none.
+func loadSubtitleSession(sessionPath string) (*subtitleSession, error) {
+	data, err := os.ReadFile(sessionPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "failed to read session")
+	}
+	var session subtitleSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "session file is corrupted, log in again")
+	}
+	return &session, nil
+}
+
+func saveSubtitleSession(sessionPath string, session subtitleSession) error {
+	data, err := lib.JSONMarshal(session)
+	if err != nil {
+		return err
+	}
+	return lib.WriteFileAtomic(sessionPath, data, 0600)
+}
+
+// Credentials remembered to renew sessions. Kept apart from the session file, so that the password
+// doesn't travel along with the token, and is only readable by the user.
+type subtitleCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Credentials file next to the session file, e.g.: opensubtitles-session.credentials.json
+func credentialsPath(sessionPath string) string {
+	return strings.TrimSuffix(sessionPath, filepath.Ext(sessionPath)) + ".credentials.json"
+}
 
-type DownloadRequestData struct {
-	FileId int `json:"file_id"`
+// Loads credentials. Returns nil when there are none.
+func loadSubtitleCredentials(sessionPath string) (*subtitleCredentials, error) {
+	data, err := os.ReadFile(credentialsPath(sessionPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "failed to read credentials")
+	}
+	var credentials subtitleCredentials
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, lib.WrapError(lib.CodeIO, err, "credentials file is corrupted, log in again")
+	}
+	return &credentials, nil
 }
 
-type DownloadResponseData struct {
-	Link         string `json:"link"`
-	FileName     string `json:"file_name"`
-	Requests     int    `json:"requests"`
-	Remaining    int    `json:"remaining"`
-	Message      string `json:"message"`
-	ResetTime    string `json:"reset_time"`
-	ResetTimeUTC string `json:"reset_time_utc"`
+func saveSubtitleCredentials(sessionPath string, credentials subtitleCredentials) error {
+	data, err := lib.JSONMarshal(credentials)
+	if err != nil {
+		return err
+	}
+	return lib.WriteFileAtomic(credentialsPath(sessionPath), data, 0600)
 }
 
 type DownloadData struct {
@@ -39,137 +241,239 @@ type DownloadData struct {
 	Remaining int    `json:"remaining"`
 	Total     int    `json:"total"`
 	ResetTime string `json:"reset_time"`
+	// Download quota after the download, when the provider reported it.
+	Quota *SubtitleQuota `json:"quota,omitempty"`
 }
 
-func SearchSubtitles(args []string) {
-	cmd := flag.NewFlagSet("search-subtitles", flag.ExitOnError)
-	argApiKey := cmd.String("api-key", "", "Open Subtitles consumer API key.")
-	argAgent := cmd.String("agent", "", "User-Agent header. Format: appname v1.0")
-	argLanguages := cmd.String("languages", "", "What languages to search for.")
-	argHash := cmd.String("hash", "", "What file to hash and add to search query.")
-	argQuery := cmd.String("query", "", "String query to use.")
-	argPage := cmd.Int("page", 1, "Results page, starting at 1.")
+type subtitleProviderFlags struct {
+	provider    *string
+	apiKey      *string
+	agent       *string
+	sessionFile *string
+	apiUrl      *string
+	client      lib.ClientFlags
+}
 
-	lib.Check(cmd.Parse(args))
+func defineSubtitleProviderFlags(cmd *flag.FlagSet) subtitleProviderFlags {
+	return subtitleProviderFlags{
+		provider:    cmd.String("provider", defaultSubtitleProvider, "Subtitle provider: "+strings.Join(subtitleProviderNames(), ", ")+"."),
+		apiKey:      cmd.String("api-key", "", "Provider's consumer API key."),
+		agent:       cmd.String("agent", "", "User-Agent header. Format: appname v1.0"),
+		sessionFile: cmd.String("session-file", "", "Where subtitles-login keeps the session. Defaults to <provider>-session.json in ziggy's config directory."),
+		apiUrl:      cmd.String("api-url", "", "Provider's API URL, e.g. of a local stand-in. Defaults to the public API, or the host assigned to the logged in account."),
+		client:      lib.DefineClientFlags(cmd),
+	}
+}
 
-	// Validation
-	if len(*argApiKey) == 0 {
-		lib.Check(errors.New("--api-key is required"))
-	}
-	if len(*argAgent) == 0 {
-		lib.Check(errors.New("--agent is required"))
-	}
-	if len(*argHash) == 0 && len(*argQuery) == 0 {
-		lib.Check(errors.New("at least one of --query or --hash is required"))
-	}
-	if len(*argLanguages) == 0 {
-		lib.Check(errors.New("--languages is required"))
-	}
-
-	// "Send request parameters sorted, and send all queries in lowercase."
-	params := []string{}
-	languageDelimiterRE := regexp.MustCompile(" *, *")
-	languages := languageDelimiterRE.Split(*argLanguages, -1)
-	slices.Sort(languages)
-	params = append(params, "languages="+escapeParam(strings.Join(languages, ",")))
-	if len(*argHash) > 0 {
-		hash, err := lib.OSDBHashFile(*argHash)
-		if err == nil {
-			params = append(params, "moviehash="+escapeParam(hash))
-		} else if len(*argQuery) == 0 {
-			lib.Check(fmt.Errorf("couldn't hash the file (%w) and query is empty", err))
+func (f subtitleProviderFlags) newProvider() SubtitleProvider {
+	lib.Check(f.client.ApplyConfig("api-url"))
+	sessionPath := *f.sessionFile
+	if sessionPath == "" {
+		if dir := lib.ConfigDir(); dir != "" {
+			sessionPath = filepath.Join(dir, *f.provider+"-session.json")
 		}
 	}
-	params = append(params, "page="+escapeParam(fmt.Sprint(*argPage)))
-	if len(*argQuery) > 0 {
-		params = append(params, "query="+escapeParam(*argQuery))
-	}
+	return lib.Must(newSubtitleProvider(*f.provider, subtitleProviderOptions{
+		// Rate limits are only waited for within `--quota-wait`
+		client:      lib.Must(f.client.Client()).WithoutRateLimitRetries(),
+		apiKey:      *f.apiKey,
+		agent:       *f.agent,
+		sessionPath: sessionPath,
+		apiUrl:      *f.apiUrl,
+	}))
+}
 
-	client := http.Client{}
-	req := lib.Must(http.NewRequest("GET", OPEN_SUBTITLES_API_URL+"/subtitles?"+strings.Join(params, "&"), nil))
-	req.Header = http.Header{
-		"Api-Key":    {*argApiKey},
-		"User-Agent": {*argAgent},
+// Provider that supports accounts, or an error.
+func accountProvider(provider SubtitleProvider, name string) SubtitleAccountProvider {
+	accounts, ok := provider.(SubtitleAccountProvider)
+	if !ok {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "provider %s doesn't support login", name))
 	}
+	return accounts
+}
 
-	resp := lib.Must(client.Do(req))
-	defer resp.Body.Close()
+type searchSubtitlesFlags struct {
+	subtitleProviderFlags
+	languages *string
+	hash      *string
+	query     *string
+	page      *int
+	quotaWait *time.Duration
+}
 
-	if resp.StatusCode == http.StatusOK {
-		fmt.Print(string(lib.Must(io.ReadAll(resp.Body))))
-	} else {
-		lib.Check(errors.New(resp.Status))
+func newSearchSubtitlesFlags() (*flag.FlagSet, searchSubtitlesFlags) {
+	cmd := flag.NewFlagSet("search-subtitles", flag.ContinueOnError)
+	return cmd, searchSubtitlesFlags{
+		subtitleProviderFlags: defineSubtitleProviderFlags(cmd),
+		languages:             cmd.String("languages", "", "What languages to search for."),
+		hash:                  cmd.String("hash", "", "What file to hash and add to search query."),
+		query:                 cmd.String("query", "", "String query to use."),
+		page:                  cmd.Int("page", 1, "Results page, starting at 1."),
+		quotaWait:             cmd.Duration("quota-wait", 0, "When rate limited, wait for the limit to reset and retry, for at most this long in total."),
 	}
 }
 
-func DownloadSubtitles(args []string) {
-	cmd := flag.NewFlagSet("download-subtitles", flag.ExitOnError)
-	argApiKey := cmd.String("api-key", "", "Open Subtitles consumer API key.")
-	argAgent := cmd.String("agent", "", "User-Agent header. Format: appname v1.0")
-	argFileID := cmd.Int("file-id", 0, "Subtitle file ID to download.")
-	argDestination := cmd.String("destination", "", "Destination directory.")
-
-	lib.Check(cmd.Parse(args))
+func SearchSubtitles(ctx context.Context, args []string) any {
+	cmd, flags := newSearchSubtitlesFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
 
 	// Validation
-	if len(*argApiKey) == 0 {
-		lib.Check(errors.New("--api-key is required"))
+	if len(*flags.hash) == 0 && len(*flags.query) == 0 {
+		lib.Check(lib.NewError(lib.CodeMissingArgument, "at least one of --query or --hash is required"))
 	}
-	if len(*argAgent) == 0 {
-		lib.Check(errors.New("--agent is required"))
+	if len(*flags.languages) == 0 {
+		lib.Check(lib.MissingArgument("languages"))
 	}
-	if *argFileID == 0 {
-		lib.Check(errors.New("--file-id is required"))
+	if *flags.page < 1 {
+		lib.Check(lib.NewError(lib.CodeInvalidArgument, "--page has to be 1 or more"))
 	}
-	if len(*argDestination) == 0 {
-		lib.Check(errors.New("--destination is required"))
+
+	provider := flags.newProvider()
+	query := SubtitleQuery{
+		Languages: regexp.MustCompile(" *, *").Split(*flags.languages, -1),
+		FilePath:  *flags.hash,
+		Query:     *flags.query,
+		Page:      *flags.page,
 	}
+	return lib.Must(waitForQuota(ctx, *flags.quotaWait, func() (SubtitleSearchResult, error) {
+		return provider.Search(ctx, query)
+	}))
+}
 
-	// Create the directory if it doesn't exist
-	if _, err := os.Stat(*argDestination); os.IsNotExist(err) {
-		os.MkdirAll(*argDestination, 0755)
+type downloadSubtitlesFlags struct {
+	subtitleProviderFlags
+	fileID      *string
+	destination *string
+	progress    *bool
+	quotaWait   *time.Duration
+}
+
+func newDownloadSubtitlesFlags() (*flag.FlagSet, downloadSubtitlesFlags) {
+	cmd := flag.NewFlagSet("download-subtitles", flag.ContinueOnError)
+	return cmd, downloadSubtitlesFlags{
+		subtitleProviderFlags: defineSubtitleProviderFlags(cmd),
+		fileID:                cmd.String("file-id", "", "Subtitle file ID to download, from search results."),
+		destination:           cmd.String("destination", "", "Destination directory."),
+		progress:              cmd.Bool("progress", false, "Stream progress events as JSON lines, followed by a result line."),
+		quotaWait:             cmd.Duration("quota-wait", 0, "When rate limited, or out of downloads, wait for the quota to reset and retry, for at most this long in total."),
 	}
+}
 
-	data := bytes.NewBuffer(lib.Must(lib.JSONMarshal(DownloadRequestData{FileId: *argFileID})))
-	client := http.Client{}
-	req := lib.Must(http.NewRequest("POST", OPEN_SUBTITLES_API_URL+"/download", data))
-	req.Header = http.Header{
-		"Accept":       {"application/json"},
-		"Api-Key":      {*argApiKey},
-		"Content-Type": {"application/json"},
-		"User-Agent":   {*argAgent},
+func DownloadSubtitles(ctx context.Context, args []string) any {
+	cmd, flags := newDownloadSubtitlesFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
+	if *flags.progress {
+		lib.StartStream(ctx)
 	}
 
-	resp := lib.Must(client.Do(req))
-	defer resp.Body.Close()
+	// Validation
+	if len(*flags.fileID) == 0 {
+		lib.Check(lib.MissingArgument("file-id"))
+	}
+	if len(*flags.destination) == 0 {
+		lib.Check(lib.MissingArgument("destination"))
+	}
+
+	provider := flags.newProvider()
 
-	if resp.StatusCode != http.StatusOK {
-		lib.Check(errors.New(resp.Status))
+	// Create the directory if it doesn't exist
+	if _, err := os.Stat(*flags.destination); os.IsNotExist(err) {
+		os.MkdirAll(*flags.destination, 0755)
 	}
-	var downloadData DownloadResponseData
-	lib.Check(json.Unmarshal(lib.Must(io.ReadAll(resp.Body)), &downloadData))
-	filePath := filepath.Join(*argDestination, downloadData.FileName)
-	outFile := lib.Must(os.Create(filePath))
-	defer outFile.Close()
 
-	response := lib.Must(http.Get(downloadData.Link))
-	defer response.Body.Close()
+	return lib.Must(waitForQuota(ctx, *flags.quotaWait, func() (DownloadData, error) {
+		return provider.Download(ctx, *flags.fileID, *flags.destination, *flags.progress)
+	}))
+}
 
-	if response.StatusCode != http.StatusOK {
-		lib.Check(fmt.Errorf("downloading failed: %s", response.Status))
+type subtitlesLoginFlags struct {
+	subtitleProviderFlags
+	username      *string
+	password      *string
+	passwordStdin *bool
+	noRemember    *bool
+}
+
+func newSubtitlesLoginFlags() (*flag.FlagSet, subtitlesLoginFlags) {
+	cmd := flag.NewFlagSet("subtitles-login", flag.ContinueOnError)
+	return cmd, subtitlesLoginFlags{
+		subtitleProviderFlags: defineSubtitleProviderFlags(cmd),
+		username:              cmd.String("username", "", "Account username."),
+		password:              cmd.String("password", "", "Account password. Visible to other users in the process list, prefer --password-stdin."),
+		passwordStdin:         cmd.Bool("password-stdin", false, "Read the password from the first line of stdin. In serve mode, pass --password in args instead."),
+		noRemember:            cmd.Bool("no-remember", false, "Don't store the password to renew the session when it expires."),
 	}
+}
 
-	lib.Must(io.Copy(outFile, response.Body))
+func SubtitlesLogin(ctx context.Context, args []string) any {
+	cmd, flags := newSubtitlesLoginFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
 
-	fmt.Print(string(lib.Must(lib.JSONMarshal(DownloadData{
-		File:      filePath,
-		Remaining: downloadData.Remaining,
-		Total:     downloadData.Remaining + downloadData.Requests,
-		ResetTime: downloadData.ResetTime,
-	}))))
+	// Validation
+	if len(*flags.username) == 0 {
+		lib.Check(lib.MissingArgument("username"))
+	}
+	password := *flags.password
+	if *flags.passwordStdin {
+		if len(password) > 0 {
+			lib.Check(lib.NewError(lib.CodeInvalidArgument, "--password and --password-stdin can't be used together"))
+		}
+		if !lib.StdinAvailable(ctx) {
+			lib.Check(lib.NewError(lib.CodeInvalidArgument, "--password-stdin is not available in serve mode, pass --password in args"))
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			lib.Check(lib.WrapError(lib.CodeIO, err, "failed to read stdin"))
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if len(password) == 0 {
+		lib.Check(lib.MissingArgument("password"))
+	}
+
+	accounts := accountProvider(flags.newProvider(), *flags.provider)
+	return lib.Must(accounts.Login(ctx, *flags.username, password, !*flags.noRemember))
 }
 
-// Escape and lowercase (open subtitles requirement) a URL parameter
-func escapeParam(str string) string {
-	return url.QueryEscape(strings.ToLower(str))
+type SubtitlesLogoutResult struct {
+	Provider string `json:"provider"`
+}
+
+func newSubtitlesLogoutFlags() (*flag.FlagSet, subtitleProviderFlags) {
+	cmd := flag.NewFlagSet("subtitles-logout", flag.ContinueOnError)
+	return cmd, defineSubtitleProviderFlags(cmd)
+}
+
+func SubtitlesLogout(ctx context.Context, args []string) any {
+	cmd, flags := newSubtitlesLogoutFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
+
+	accounts := accountProvider(flags.newProvider(), *flags.provider)
+	lib.Check(accounts.Logout(ctx))
+	return SubtitlesLogoutResult{Provider: *flags.provider}
+}
+
+type SubtitleProviderInfo struct {
+	Name         string               `json:"name"`
+	Capabilities SubtitleCapabilities `json:"capabilities"`
+}
+
+type SubtitleProvidersResult struct {
+	Providers []SubtitleProviderInfo `json:"providers"`
+}
+
+func newSubtitleProvidersFlags() *flag.FlagSet {
+	return flag.NewFlagSet("subtitle-providers", flag.ContinueOnError)
+}
+
+func SubtitleProviders(_ context.Context, args []string) any {
+	cmd := newSubtitleProvidersFlags()
+	lib.Check(lib.ParseFlags(cmd, args))
+
+	result := SubtitleProvidersResult{Providers: []SubtitleProviderInfo{}}
+	for _, name := range subtitleProviderNames() {
+		provider := subtitleProviders[name](subtitleProviderOptions{})
+		result.Providers = append(result.Providers, SubtitleProviderInfo{Name: name, Capabilities: provider.Capabilities()})
+	}
+	return result
 }
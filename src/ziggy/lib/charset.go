@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Characters 0x80-0x9F of windows-1252 that differ from ISO-8859-1. Zero entries are undefined
+// and decoded as their ISO-8859-1 control characters, like browsers do.
+var windows1252 = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, 0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// Converts text in a charset to UTF-8. Supports UTF-8, UTF-16, US-ASCII, ISO-8859-1, and windows-1252.
+// Returns false when the charset is not supported, in which case data is returned unchanged.
+func DecodeCharset(data []byte, charset string) ([]byte, bool) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")), true
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return decodeSingleByte(data, false), true
+	case "windows-1252", "cp1252":
+		return decodeSingleByte(data, true), true
+	case "utf-16":
+		// Byte order mark decides, big endian is the default
+		if bytes.HasPrefix(data, []byte{0xFF, 0xFE}) {
+			return decodeUTF16(data[2:], binary.LittleEndian), true
+		}
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFE, 0xFF}), binary.BigEndian), true
+	case "utf-16le":
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFF, 0xFE}), binary.LittleEndian), true
+	case "utf-16be":
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFE, 0xFF}), binary.BigEndian), true
+	default:
+		return data, false
+	}
+}
+
+func decodeSingleByte(data []byte, windows bool) []byte {
+	result := make([]byte, 0, len(data))
+	for _, b := range data {
+		char := rune(b)
+		if windows && b >= 0x80 && b <= 0x9F && windows1252[b-0x80] != 0 {
+			char = windows1252[b-0x80]
+		}
+		result = utf8.AppendRune(result, char)
+	}
+	return result
+}
+
+func decodeUTF16(data []byte, order binary.ByteOrder) []byte {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, order.Uint16(data[i:]))
+	}
+	return []byte(string(utf16.Decode(units)))
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const configFileName = "config.json"
+
+// Directory where ziggy keeps its config and state. Empty when it can't be determined.
+func ConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "uosc", "ziggy")
+}
+
+// Path of the config file used when `--config` isn't passed. `ZIGGY_CONFIG` environment variable overrides it.
+func defaultConfigPath() string {
+	if path := os.Getenv("ZIGGY_CONFIG"); path != "" {
+		return path
+	}
+	if dir := ConfigDir(); dir != "" {
+		return filepath.Join(dir, configFileName)
+	}
+	return ""
+}
+
+// Sets flags in `names` that weren't passed explicitly to values from a config file.
+// Config is a JSON object with flag names as keys, e.g.: `{"proxy": "socks5://host:1080", "insecure": true}`.
+// Missing file is only an error when it was requested explicitly.
+func applyConfig(cmd *flag.FlagSet, configPath string, explicit bool, names []string) error {
+	if configPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	} else if err != nil {
+		return WrapError(CodeIO, err, "failed to read config file")
+	}
+
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return WrapError(CodeInvalidArgument, err, "invalid config file %s", configPath)
+	}
+
+	passed := map[string]bool{}
+	cmd.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+
+	for name, raw := range config {
+		if !slices.Contains(names, name) || passed[name] {
+			continue
+		}
+		value := string(bytes.TrimSpace(raw))
+		if len(value) > 0 && value[0] == '"' {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return WrapError(CodeInvalidArgument, err, "invalid config value %s", name)
+			}
+		}
+		if err := cmd.Set(name, value); err != nil {
+			return WrapError(CodeInvalidArgument, err, "invalid config value %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package lib
+
+import "context"
+
+type stdinUnavailableKey struct{}
+
+// Marks stdin as unavailable to commands, like in serve mode where it carries requests.
+func WithoutStdin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stdinUnavailableKey{}, true)
+}
+
+// Whether commands running in this context can read from stdin.
+func StdinAvailable(ctx context.Context) bool {
+	unavailable, _ := ctx.Value(stdinUnavailableKey{}).(bool)
+	return !unavailable
+}
@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+type cookieEntry struct {
+	Domain            string // Without the leading dot.
+	IncludeSubdomains bool
+	Path              string
+	Secure            bool
+	HttpOnly          bool
+	Expires           int64 // Unix time, 0 for session cookies.
+	Name              string
+	Value             string
+}
+
+func (e cookieEntry) key() string {
+	return e.Domain + ";" + e.Path + ";" + e.Name
+}
+
+func (e cookieEntry) expired(now time.Time) bool {
+	return e.Expires != 0 && e.Expires <= now.Unix()
+}
+
+func (e cookieEntry) matches(u *url.URL, now time.Time) bool {
+	host := strings.ToLower(u.Hostname())
+	domainMatches := host == e.Domain || (e.IncludeSubdomains && strings.HasSuffix(host, "."+e.Domain))
+	requestPath := u.EscapedPath()
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	pathMatches := requestPath == e.Path || (strings.HasPrefix(requestPath, e.Path) &&
+		(strings.HasSuffix(e.Path, "/") || requestPath[len(e.Path)] == '/'))
+	return domainMatches && pathMatches && (!e.Secure || u.Scheme == "https") && !e.expired(now)
+}
+
+// Cookie jar persisted in a Netscape `cookies.txt` file, the format used by curl, yt-dlp, and mpv.
+// Changes are saved right away, and merged with changes made by other processes in the meantime.
+type CookieJar struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]cookieEntry
+}
+
+// Loads a cookie jar from a file. File doesn't have to exist, and is created once there's a cookie to save.
+func LoadCookieJar(filePath string) (*CookieJar, error) {
+	jar := &CookieJar{path: filePath}
+	entries, err := readCookieFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	jar.entries = entries
+	return jar, nil
+}
+
+func readCookieFile(filePath string) (map[string]cookieEntry, error) {
+	entries := map[string]cookieEntry{}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, WrapError(CodeIO, err, "failed to read cookie jar")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, NewError(CodeInvalidArgument, "invalid cookie jar line: %s", line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, NewError(CodeInvalidArgument, "invalid cookie expiration: %s", fields[4])
+		}
+		entry := cookieEntry{
+			Domain:            strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			IncludeSubdomains: strings.EqualFold(fields[1], "TRUE"),
+			Path:              fields[2],
+			Secure:            strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly:          httpOnly,
+			Expires:           expires,
+			Name:              fields[5],
+			Value:             fields[6],
+		}
+		entries[entry.key()] = entry
+	}
+	return entries, nil
+}
+
+func writeCookieFile(filePath string, entries map[string]cookieEntry) error {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var data bytes.Buffer
+	data.WriteString("# Netscape HTTP Cookie File\n")
+	for _, key := range keys {
+		entry := entries[key]
+		domain := entry.Domain
+		if entry.IncludeSubdomains {
+			domain = "." + domain
+		}
+		if entry.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		fmt.Fprintf(&data, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, netscapeBool(entry.IncludeSubdomains),
+			entry.Path, netscapeBool(entry.Secure), entry.Expires, entry.Name, entry.Value)
+	}
+	return WriteFileAtomic(filePath, data.Bytes(), 0600)
+}
+
+func netscapeBool(value bool) string {
+	if value {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	now := time.Now()
+	host := strings.ToLower(u.Hostname())
+	changes := map[string]*cookieEntry{}
+
+	for _, cookie := range cookies {
+		entry := cookieEntry{
+			Domain:   host,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+		}
+
+		// Domain cookies can only be set by the domain itself or its subdomains, and not for IPs or top level domains
+		if domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, ".")); domain != "" {
+			if net.ParseIP(host) != nil && domain != host {
+				continue
+			}
+			if (host != domain && !strings.HasSuffix(host, "."+domain)) || !strings.Contains(domain, ".") {
+				continue
+			}
+			entry.Domain = domain
+			entry.IncludeSubdomains = true
+		}
+
+		if !strings.HasPrefix(entry.Path, "/") {
+			entry.Path = defaultCookiePath(u)
+		}
+
+		switch {
+		case cookie.MaxAge < 0:
+			entry.Expires = now.Unix()
+		case cookie.MaxAge > 0:
+			entry.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second).Unix()
+		case !cookie.Expires.IsZero():
+			entry.Expires = max(cookie.Expires.Unix(), 1)
+		}
+
+		if entry.expired(now) {
+			changes[entry.key()] = nil
+		} else {
+			changes[entry.key()] = &entry
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+	applyCookieChanges(j.entries, changes)
+
+	// Persist right away, as requests don't have a point where the jar could be closed
+	unlock, err := LockFile(context.Background(), j.path+".lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+	entries, err := readCookieFile(j.path)
+	if err != nil {
+		return
+	}
+	applyCookieChanges(entries, changes)
+	writeCookieFile(j.path, entries)
+}
+
+func applyCookieChanges(entries map[string]cookieEntry, changes map[string]*cookieEntry) {
+	for key, entry := range changes {
+		if entry == nil {
+			delete(entries, key)
+		} else {
+			entries[key] = *entry
+		}
+	}
+}
+
+// Directory of the request path, as defined by RFC 6265.
+func defaultCookiePath(u *url.URL) string {
+	requestPath := u.EscapedPath()
+	if !strings.HasPrefix(requestPath, "/") || strings.Count(requestPath, "/") == 1 {
+		return "/"
+	}
+	return path.Dir(requestPath)
+}
+
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	now := time.Now()
+	matching := []cookieEntry{}
+	for _, entry := range j.entries {
+		if entry.matches(u, now) {
+			matching = append(matching, entry)
+		}
+	}
+	// Longer paths first
+	slices.SortFunc(matching, func(a, b cookieEntry) int { return len(b.Path) - len(a.Path) })
+
+	cookies := make([]*http.Cookie, 0, len(matching))
+	for _, entry := range matching {
+		cookies = append(cookies, &http.Cookie{Name: entry.Name, Value: entry.Value})
+	}
+	return cookies
+}
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+)
+
+// Stable machine readable error codes. Callers branch on these, so never change existing ones.
+type ErrorCode string
+
+const (
+	CodeUnknown           ErrorCode = "unknown"
+	CodeInternal          ErrorCode = "internal"
+	CodeUnknownCommand    ErrorCode = "unknown_command"
+	CodeMissingArgument   ErrorCode = "missing_argument"
+	CodeInvalidArgument   ErrorCode = "invalid_argument"
+	CodeHTTPStatus        ErrorCode = "http_status"
+	CodeRateLimited       ErrorCode = "rate_limited"
+	CodeNetwork           ErrorCode = "network"
+	CodeTimeout           ErrorCode = "timeout"
+	CodeCanceled          ErrorCode = "canceled"
+	CodeIO                ErrorCode = "io"
+	CodeUnsupportedFormat ErrorCode = "unsupported_format"
+	CodeInvalidResponse   ErrorCode = "invalid_response"
+	CodeUnavailable       ErrorCode = "unavailable"
+	CodeChecksumMismatch  ErrorCode = "checksum_mismatch"
+	CodeFileExists        ErrorCode = "file_exists"
+	CodeTLS               ErrorCode = "tls"          // Server certificate couldn't be verified.
+	CodeUnauthorized      ErrorCode = "unauthorized" // Credentials were rejected, or the session expired. Log in again.
+)
+
+type ErrorData struct {
+	Error      bool      `json:"error"`
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Retryable  bool      `json:"retryable"`
+	Details    any       `json:"details,omitempty"`
+}
+
+// Error with a machine readable code. Use `NewError` or `WrapError` to create it.
+type Error struct {
+	Code       ErrorCode
+	Message    string
+	HTTPStatus int
+	Retryable  bool
+	Details    any
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		if e.Message == "" {
+			return e.Err.Error()
+		}
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Attaches additional data to the error.
+func (e *Error) WithDetails(details any) *Error {
+	e.Details = details
+	return e
+}
+
+// Creates a new error with a code. Network related codes are retryable.
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Retryable: isRetryableCode(code)}
+}
+
+// Wraps an error with a code and a message prefix. Message can be empty.
+func WrapError(code ErrorCode, err error, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Err: err, Retryable: isRetryableCode(code)}
+}
+
+// Error for a required argument that wasn't passed. Name is the flag name without dashes.
+func MissingArgument(name string) *Error {
+	return NewError(CodeMissingArgument, "--%s is required", name)
+}
+
+// Error for a non-OK HTTP response. 429 produces `rate_limited`, and 5xx are retryable.
+func HTTPStatusError(resp *http.Response) *Error {
+	code := CodeHTTPStatus
+	if resp.StatusCode == http.StatusTooManyRequests {
+		code = CodeRateLimited
+	}
+	err := NewError(code, "non-OK HTTP status: %s", resp.Status)
+	err.HTTPStatus = resp.StatusCode
+	err.Retryable = code == CodeRateLimited || resp.StatusCode >= 500
+	return err
+}
+
+// Wraps an error returned by copying a response body into a file. File errors are `io`,
+// errors that already have a code keep it, cancellations and deadlines are `canceled` and `timeout`,
+// and everything else is the connection failing mid transfer.
+func WrapCopyError(err error, format string, args ...any) *Error {
+	var pathErr *fs.PathError
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return WrapError(e.Code, err, format, args...)
+	case errors.Is(err, context.Canceled):
+		return WrapError(CodeCanceled, err, format, args...)
+	case errors.Is(err, context.DeadlineExceeded):
+		return WrapError(CodeTimeout, err, format, args...)
+	case errors.As(err, &pathErr):
+		return WrapError(CodeIO, err, format, args...)
+	}
+	return WrapError(CodeNetwork, err, format, args...)
+}
+
+// Parses command flags, reporting failures as `invalid_argument` errors.
+func ParseFlags(cmd *flag.FlagSet, args []string) error {
+	if err := cmd.Parse(args); err != nil {
+		return WrapError(CodeInvalidArgument, err, "")
+	}
+	return nil
+}
+
+// Parses command flags that can be interspersed with positional arguments, like in
+// `cmd <subcommand> --flag value <arg>`. Returns the positional arguments.
+// Everything after a `--` terminator is positional.
+func ParseFlagsInterspersed(cmd *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := ParseFlags(cmd, args); err != nil {
+			return nil, err
+		}
+		rest := cmd.Args()
+		consumed := len(args) - len(rest)
+		if len(rest) == 0 || (consumed > 0 && args[consumed-1] == "--") {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func isRetryableCode(code ErrorCode) bool {
+	return code == CodeNetwork || code == CodeTimeout || code == CodeRateLimited
+}
+
+// Converts any error into `ErrorData`. Errors without a code are classified by their type.
+func NewErrorData(err error) ErrorData {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = classifyError(err)
+	}
+	return ErrorData{
+		Error:      true,
+		Code:       e.Code,
+		Message:    err.Error(),
+		HTTPStatus: e.HTTPStatus,
+		Retryable:  e.Retryable,
+		Details:    e.Details,
+	}
+}
+
+func classifyError(err error) *Error {
+	var netErr net.Error
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return WrapError(CodeCanceled, err, "")
+	case errors.Is(err, context.DeadlineExceeded):
+		return WrapError(CodeTimeout, err, "")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return WrapError(CodeTimeout, err, "")
+	case errors.As(err, &netErr):
+		return WrapError(CodeNetwork, err, "")
+	case errors.As(err, &pathErr):
+		return WrapError(CodeIO, err, "")
+	default:
+		return WrapError(CodeUnknown, err, "")
+	}
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+type emitterKey struct{}
+
+// Returns a context through which commands can stream events while they run.
+// Emitter has to be safe to call from multiple goroutines.
+func WithEmitter(ctx context.Context, emit func(event any)) context.Context {
+	return context.WithValue(ctx, emitterKey{}, emit)
+}
+
+// Sends an event to the emitter of the context. Does nothing when there is none.
+func Emit(ctx context.Context, event any) {
+	if emit, ok := ctx.Value(emitterKey{}).(func(event any)); ok {
+		emit(event)
+	}
+}
+
+type streamKey struct{}
+
+// Returns a context through which commands announce that they stream events.
+// Called at most once per command, from the command's goroutine.
+func WithStreamListener(ctx context.Context, onStream func()) context.Context {
+	return context.WithValue(ctx, streamKey{}, onStream)
+}
+
+// Announces that the command streams events, so that its result is tagged as the last line of the stream
+// even when it finishes before emitting any. Call it as soon as the command knows it will stream.
+func StartStream(ctx context.Context) {
+	if onStream, ok := ctx.Value(streamKey{}).(func()); ok {
+		onStream()
+	}
+}
+
+// Marshals `t` into JSON and adds a `type` property to it.
+// Used to tag the final line of a stream of events.
+func JSONMarshalTagged(eventType string, t any) ([]byte, error) {
+	data, err := JSONMarshal(t)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := JSONMarshal(eventType)
+	if err != nil {
+		return nil, err
+	}
+	tag = bytes.TrimSpace(tag)
+
+	// Non-object values can't have properties, so they are wrapped
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) < 2 || trimmed[0] != '{' {
+		return JSONMarshal(map[string]any{"type": eventType, "result": t})
+	}
+
+	result := append([]byte(`{"type":`), tag...)
+	if !bytes.Equal(trimmed, []byte("{}")) {
+		result = append(result, ',')
+	}
+	result = append(result, trimmed[1:]...)
+	return append(result, '\n'), nil
+}
+
+type ProgressEvent struct {
+	Type  string  `json:"type"`
+	Bytes int64   `json:"bytes"`
+	Total *int64  `json:"total,omitempty"` // Omitted when size is unknown.
+	Speed float64 `json:"speed"`           // Bytes per second since the previous event.
+}
+
+const progressInterval = 250 * time.Millisecond
+
+// Writer that counts bytes written through it and emits throttled progress events.
+// Meant to be used with `io.TeeReader` or `io.MultiWriter`.
+type ProgressWriter struct {
+	ctx       context.Context
+	total     int64
+	mutex     sync.Mutex
+	bytes     int64
+	lastBytes int64
+	lastEmit  time.Time
+}
+
+// Creates a progress writer. Total is the expected size, or -1 when unknown.
+// Bytes already present, like when resuming a download, can be passed in `offset`.
+func NewProgressWriter(ctx context.Context, total int64, offset int64) *ProgressWriter {
+	return &ProgressWriter{ctx: ctx, total: total, bytes: offset, lastBytes: offset, lastEmit: time.Now()}
+}
+
+func (p *ProgressWriter) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytes += int64(len(b))
+	if time.Since(p.lastEmit) >= progressInterval {
+		p.emit()
+	}
+	return len(b), nil
+}
+
+// Emits the final progress event.
+func (p *ProgressWriter) Done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.emit()
+}
+
+func (p *ProgressWriter) emit() {
+	now := time.Now()
+	event := ProgressEvent{Type: "progress", Bytes: p.bytes}
+	if p.total >= 0 {
+		total := p.total
+		event.Total = &total
+	}
+	if elapsed := now.Sub(p.lastEmit).Seconds(); elapsed > 0 {
+		event.Speed = float64(p.bytes-p.lastBytes) / elapsed
+	}
+	p.lastBytes = p.bytes
+	p.lastEmit = now
+	Emit(p.ctx, event)
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockRetryInterval = 50 * time.Millisecond
+	lockTimeout       = 10 * time.Second
+	// Locks older than this are considered abandoned by a crashed process.
+	lockStaleAge = 30 * time.Second
+)
+
+// Writes a file by writing into a temporary file first, and renaming it over the destination,
+// so that readers never see a half written file.
+func WriteFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return WrapError(CodeIO, err, "failed to create directory %s", dir)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return WrapError(CodeIO, err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return WrapError(CodeIO, err, "failed to write %s", filePath)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return WrapError(CodeIO, err, "failed to write %s", filePath)
+	}
+	if err := tmp.Close(); err != nil {
+		return WrapError(CodeIO, err, "failed to write %s", filePath)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return WrapError(CodeIO, err, "failed to write %s", filePath)
+	}
+	return nil
+}
+
+// Acquires an exclusive lock shared between processes by creating a lock file.
+// Returns a function that releases the lock.
+func LockFile(ctx context.Context, lockPath string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm); err != nil {
+		return nil, WrapError(CodeIO, err, "failed to create directory for %s", lockPath)
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, WrapError(CodeIO, err, "failed to create lock %s", lockPath)
+		}
+
+		if stat, err := os.Stat(lockPath); err == nil && time.Since(stat.ModTime()) > lockStaleAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, NewError(CodeIO, "timed out waiting for lock %s", lockPath)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
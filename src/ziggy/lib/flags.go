@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"flag"
+	"strings"
+)
+
+// Flag that can be passed multiple times, collecting all values.
+type StringList []string
+
+func (l *StringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *StringList) Get() any {
+	return []string(*l)
+}
+
+// Defines a flag that can be passed multiple times.
+func StringListFlag(cmd *flag.FlagSet, name string, usage string) *StringList {
+	list := &StringList{}
+	cmd.Var(list, name, usage)
+	return list
+}
@@ -4,28 +4,37 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"os"
 )
 
-type ErrorData struct {
-	Error   bool   `json:"error"`
-	Message string `json:"message"`
+// Panic payload used by `Check` to abort the current command.
+type failure struct {
+	err error
 }
 
+// Aborts the current command with `err` when it's not nil.
+// The error is turned into `ErrorData` by `Run`.
 func Check(err error) {
 	if err != nil {
-		res := ErrorData{Error: true, Message: err.Error()}
-		json, err := json.Marshal(res)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Print(string(json))
-		os.Exit(0)
+		panic(failure{err})
 	}
 }
 
+// Runs a command and returns its result, or `ErrorData` if the command was aborted with `Check`.
+func Run(command func() any) (result any) {
+	defer func() {
+		if r := recover(); r != nil {
+			if f, ok := r.(failure); ok {
+				result = NewErrorData(f.err)
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	return command()
+}
+
 func Must[T any](t T, err error) T {
 	Check(err)
 	return t
@@ -37,15 +46,15 @@ const OSDBChunkSize = 65536 // 64k
 func OSDBHashFile(filePath string) (hash string, err error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", errors.New("couldn't open file for hashing")
+		return "", WrapError(CodeIO, err, "couldn't open file for hashing")
 	}
 
 	fi, err := file.Stat()
 	if err != nil {
-		return "", errors.New("couldn't stat file for hashing")
+		return "", WrapError(CodeIO, err, "couldn't stat file for hashing")
 	}
 	if fi.Size() < OSDBChunkSize {
-		return "", errors.New("file is too small to generate a valid OSDB hash")
+		return "", NewError(CodeUnsupportedFormat, "file is too small to generate a valid OSDB hash")
 	}
 
 	// Read head and tail blocks
@@ -80,10 +89,10 @@ func OSDBHashFile(filePath string) (hash string, err error) {
 func readChunk(file *os.File, offset int64, buf []byte) (err error) {
 	n, err := file.ReadAt(buf, offset)
 	if err != nil {
-		return err
+		return WrapError(CodeIO, err, "couldn't read file for hashing")
 	}
 	if n != OSDBChunkSize {
-		return fmt.Errorf("invalid read %v", n)
+		return NewError(CodeIO, "invalid read %v", n)
 	}
 	return
 }
@@ -1,54 +1,60 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"os"
+	"sync"
 	"uosc/bins/src/ziggy/commands"
+	"uosc/bins/src/ziggy/lib"
 )
 
 func main() {
 	command := "help"
-	args := os.Args[2:]
+	args := []string{}
 
 	if len(os.Args) > 1 {
 		command = os.Args[1]
+		args = os.Args[2:]
 	}
 
-	switch command {
-	case "search-subtitles":
-		commands.SearchSubtitles(args)
-
-	case "download-subtitles":
-		commands.DownloadSubtitles(args)
-
-	case "get-clipboard":
-		commands.GetClipboard(args)
-
-	case "set-clipboard":
-		commands.SetClipboard(args)
-
-	case "download":
-		commands.Download(args)
-
-	case "http-get":
-		commands.Http("GET", args)
-
-	case "http-post":
-		commands.Http("POST", args)
-
-	case "http-put":
-		commands.Http("PUT", args)
-
-	case "http-patch":
-		commands.Http("PATCH", args)
-
-	case "http-delete":
-		commands.Http("DELETE", args)
-
-	case "open":
-		commands.Open(args)
-
+	// Commands that stream events print them as JSON lines, and their result is tagged as the last one
+	var mutex sync.Mutex
+	streaming := false
+	ctx := lib.WithEmitter(context.Background(), func(event any) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		streaming = true
+		fmt.Print(string(lib.Must(lib.JSONMarshal(event))))
+	})
+	ctx = lib.WithStreamListener(ctx, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		streaming = true
+	})
+
+	result := lib.Run(func() any {
+		return commands.Dispatch(ctx, command, args)
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch result := result.(type) {
+	case nil:
+	case commands.Text:
+		fmt.Print(string(result))
+	case lib.ErrorData:
+		if streaming {
+			fmt.Print(string(lib.Must(lib.JSONMarshalTagged("error", result))))
+		} else {
+			fmt.Print(string(lib.Must(lib.JSONMarshal(result))))
+		}
 	default:
-		panic(errors.New("command required"))
+		if streaming {
+			fmt.Print(string(lib.Must(lib.JSONMarshalTagged("result", result))))
+		} else {
+			fmt.Print(string(lib.Must(lib.JSONMarshal(result))))
+		}
 	}
 }
@@ -45,6 +45,8 @@ elseif ($args[0] -eq "ziggy") {
 	$env:GOARCH = "amd64"
 	$Src = "./src/ziggy/ziggy.go"
 	$OutDir = "./src/uosc/bin"
+	$Version = (Select-String -Path "./src/uosc/main.lua" -Pattern "^local uosc_version = '(.*)'$").Matches[0].Groups[1].Value
+	$LdFlags = "-s -w -X uosc/bins/src/ziggy/commands.Version=$Version"
 
 	if (!(Test-Path $OutDir)) {
 		New-Item -ItemType Directory -Force -Path $OutDir > $null
@@ -52,15 +54,15 @@ elseif ($args[0] -eq "ziggy") {
 
 	Write-Output "Building for Windows..."
 	$env:GOOS = "windows"
-	go build -ldflags "-s -w" -o "$OutDir/ziggy-windows.exe" $Src
+	go build -ldflags $LdFlags -o "$OutDir/ziggy-windows.exe" $Src
 
 	Write-Output "Building for Linux..."
 	$env:GOOS = "linux"
-	go build -ldflags "-s -w" -o "$OutDir/ziggy-linux" $Src
+	go build -ldflags $LdFlags -o "$OutDir/ziggy-linux" $Src
 
 	Write-Output "Building for MacOS..."
 	$env:GOOS = "darwin"
-	go build -ldflags "-s -w" -o "$OutDir/ziggy-darwin" $Src
+	go build -ldflags $LdFlags -o "$OutDir/ziggy-darwin" $Src
 
 	if ($args[1] -eq "-c") {
 		Write-Output "Compressing binaries..."